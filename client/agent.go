@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/go-osstat/memory"
+)
+
+// With -agent the client waits for a controller (see controller.go) instead of
+// running tests. For every run the controller connects, pushes the scenario of
+// the agent, has it start the client or the server at a time it chooses, and
+// collects the reports, the output and the host's details when it's done.
+// Messages are JSON objects, one after another, on the control connection.
+// The prepare message carries the token the agent was started with, as anyone
+// who can reach the agent could otherwise run whatever they like on its host.
+const (
+	agentPrepare = "prepare" // controller: role, args and files of the run
+	agentReady   = "ready"   // agent: files are in place, with the host and its clock
+	agentStart   = "start"   // controller: start at At, on the agent's clock
+	agentStarted = "started" // agent: running, and accepting on Ready if set
+	agentStop    = "stop"    // controller: stop a server
+	agentDone    = "done"    // agent: exited, with the output
+	agentError   = "error"   // agent: the run failed before it ended
+
+	agentRoleClient = "client"
+	agentRoleServer = "server"
+)
+
+type agentMessage struct {
+	Type     string            `json:"type"`
+	Token    string            `json:"token,omitempty"`
+	Role     string            `json:"role,omitempty"`
+	Args     []string          `json:"args,omitempty"`
+	Files    map[string][]byte `json:"files,omitempty"` // pushed to the agent, or the output collected from it
+	Ready    string            `json:"ready,omitempty"` // host:port the server accepts on once up
+	At       time.Time         `json:"at,omitempty"`
+	Clock    time.Time         `json:"clock,omitempty"`
+	Host     *hostInfo         `json:"host,omitempty"`
+	ExitCode int               `json:"exitCode,omitempty"`
+	Log      string            `json:"log,omitempty"` // stdout and stderr of the run
+	Error    string            `json:"error,omitempty"`
+}
+
+// What a result depends on of the machine it ran on.
+type hostInfo struct {
+	Hostname string `json:"hostname"`
+	Os       string `json:"os"`
+	Arch     string `json:"arch"`
+	Cpus     int    `json:"cpus"`
+	Kernel   string `json:"kernel"`
+	Memory   uint64 `json:"memoryBytes"`
+	Go       string `json:"go"`
+	Quic     string `json:"quic"`
+}
+
+func localHostInfo() *hostInfo {
+	info := &hostInfo{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Cpus: runtime.NumCPU(),
+		Go:   runtime.Version(),
+		Quic: moduleVersion("github.com/lucas-clemente/quic-go"),
+	}
+	info.Hostname, _ = os.Hostname()
+	if kernel, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		info.Kernel = strings.TrimSpace(string(kernel))
+	}
+	if stats, err := memory.Get(); err == nil {
+		info.Memory = stats.Total
+	}
+	return info
+}
+
+// A control connection, on which both ends may send at once.
+type controlConn struct {
+	conn    net.Conn
+	decoder *json.Decoder
+
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newControlConn(conn net.Conn) *controlConn {
+	return &controlConn{conn: conn, decoder: json.NewDecoder(conn), encoder: json.NewEncoder(conn)}
+}
+
+func (c *controlConn) send(message *agentMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.encoder.Encode(message)
+}
+
+// Read the next message, which must be of the type expected.
+func (c *controlConn) receive(expected string) (*agentMessage, error) {
+	message := &agentMessage{}
+	if err := c.decoder.Decode(message); err != nil {
+		return nil, err
+	}
+	if message.Type == agentError {
+		return nil, fmt.Errorf("%s: %s", c.conn.RemoteAddr(), message.Error)
+	}
+	if message.Type != expected {
+		return nil, fmt.Errorf("%s: expected %s, got %s", c.conn.RemoteAddr(), expected, message.Type)
+	}
+	return message, nil
+}
+
+// Flags a controller may not pass to a run: they would have it write outside
+// of its directory, or serve controllers of its own.
+var agentForbiddenFlags = map[string]bool{
+	"agent":            true,
+	"agentServer":      true,
+	"agentToken":       true,
+	"controller":       true,
+	"controllerOutput": true,
+	"output":           true,
+	"checkpoint":       true,
+	"importHar":        true,
+	"fanInWorker":      true,
+}
+
+func checkAgentArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if agentForbiddenFlags[name] {
+			return fmt.Errorf("-%s can't be given to an agent run", name)
+		}
+	}
+	return nil
+}
+
+// Serve controllers presenting token one after another on addr, running servers with the server binary.
+func agentMain(addr string, serverBinary string, token string) error {
+	if token == "" {
+		return fmt.Errorf("an agent needs -agentToken")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Printf("Agent waiting for a controller on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Controller connected from %s\n", conn.RemoteAddr())
+		control := newControlConn(conn)
+		if err := agentRun(control, serverBinary, token); err != nil {
+			fmt.Printf("Agent run failed: %s\n", err)
+			control.send(&agentMessage{Type: agentError, Error: err.Error()})
+		}
+		conn.Close()
+	}
+}
+
+// One run: prepare, start, then report when the child exits, or is stopped.
+func agentRun(control *controlConn, serverBinary string, token string) error {
+	prepare, err := control.receive(agentPrepare)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(prepare.Token), []byte(token)) != 1 {
+		return fmt.Errorf("%s: wrong agent token", control.conn.RemoteAddr())
+	}
+	if err := checkAgentArgs(prepare.Args); err != nil {
+		return err
+	}
+	workDir, err := ioutil.TempDir("", "goquic-agent-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	runOutput := filepath.Join(workDir, "output")
+	if err := os.Mkdir(runOutput, 0777); err != nil {
+		return err
+	}
+	for name, content := range prepare.Files {
+		if filepath.Base(name) != name {
+			return fmt.Errorf("pushed file %q must be a plain file name", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(workDir, name), content, 0666); err != nil {
+			return err
+		}
+	}
+
+	var binary string
+	args := prepare.Args
+	switch prepare.Role {
+	case agentRoleClient:
+		if binary, err = os.Executable(); err != nil {
+			return err
+		}
+		args = append([]string{"-output", runOutput}, args...)
+	case agentRoleServer:
+		binary = serverBinary
+	default:
+		return fmt.Errorf("unknown agent role %q", prepare.Role)
+	}
+	if err := control.send(&agentMessage{Type: agentReady, Clock: time.Now(), Host: localHostInfo()}); err != nil {
+		return err
+	}
+
+	start, err := control.receive(agentStart)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Until(start.At))
+
+	var log logBuffer
+	child := exec.Command(binary, args...)
+	child.Dir = workDir
+	child.Stdout = &log
+	child.Stderr = &log
+	fmt.Printf("Starting %s %s %s\n", prepare.Role, binary, strings.Join(args, " "))
+	if err := child.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- child.Wait()
+	}()
+
+	if err := waitAccepting(prepare.Ready, exited); err != nil {
+		child.Process.Kill()
+		return err
+	}
+	if err := control.send(&agentMessage{Type: agentStarted, Clock: time.Now()}); err != nil {
+		child.Process.Kill()
+		return err
+	}
+
+	// A stop, or the controller going away, ends the child.
+	go func() {
+		control.receive(agentStop)
+		child.Process.Kill()
+	}()
+
+	errChild := <-exited
+	exitCode := 0
+	if exitErr, ok := errChild.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if errChild != nil {
+		return errChild
+	}
+	fmt.Printf("The %s exited with %d\n", prepare.Role, exitCode)
+
+	files, err := readOutput(runOutput)
+	if err != nil {
+		return err
+	}
+	return control.send(&agentMessage{Type: agentDone, ExitCode: exitCode, Files: files, Log: log.String()})
+}
+
+// Wait for a server to accept on addr, giving up if it exits first.
+func waitAccepting(addr string, exited chan error) error {
+	if addr == "" {
+		return nil
+	}
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		select {
+		case err := <-exited:
+			exited <- err
+			return fmt.Errorf("exited before accepting on %s: %v", addr, err)
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("not accepting on %s after 30s", addr)
+}
+
+// The files of the output directory of a run, by name.
+func readOutput(dir string) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = content
+	}
+	return files, nil
+}
+
+// Output of a child, written to from its stdout and stderr at once.
+type logBuffer struct {
+	mu      sync.Mutex
+	builder strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.builder.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.builder.String()
+}
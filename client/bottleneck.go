@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The bottleneck fan-in flows share, set up with tc on the client's route to
+// the server for the length of a run, like docker-tc does for whole containers
+// (see the README). Packets to the flows' ports go through an htb class limited
+// to the rate, netem for the delay if any, and a drop-tail queue of so many
+// bytes; everything else is left alone. It's in the kernel rather than a relay
+// so that TCP and QUIC both see the losses and the queueing, where a relay in
+// user space would end the TCP connection and hide them from its sender.
+// Needs root, or NET_ADMIN. The device must have the kernel's default root
+// qdisc, which the bottleneck replaces while it runs and gets back after: it
+// refuses to start over shaping installed by anything else, docker-tc included.
+type bottleneckSettings struct {
+	rate  string // tc rate, like 20mbit
+	delay string // one way, like 20ms, none if empty
+	queue int    // bytes
+}
+
+// Parse a bottleneck like rate=20mbit,delay=20ms,queue=262144.
+func parseBottleneck(spec string) (*bottleneckSettings, error) {
+	b := &bottleneckSettings{queue: 262144}
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid bottleneck setting %q, expected rate=, delay= or queue=", field)
+		}
+		switch parts[0] {
+		case "rate":
+			b.rate = parts[1]
+		case "delay":
+			b.delay = parts[1]
+		case "queue":
+			queue, err := strconv.Atoi(parts[1])
+			if err != nil || queue <= 0 {
+				return nil, fmt.Errorf("invalid bottleneck queue %q, expected bytes", parts[1])
+			}
+			b.queue = queue
+		default:
+			return nil, fmt.Errorf("unknown bottleneck setting %q", parts[0])
+		}
+	}
+	if b.rate == "" {
+		return nil, fmt.Errorf("bottleneck %q has no rate", spec)
+	}
+	return b, nil
+}
+
+func (b *bottleneckSettings) String() string {
+	if b == nil {
+		return "none"
+	}
+	label := fmt.Sprintf("rate=%s queue=%d", b.rate, b.queue)
+	if b.delay != "" {
+		label += " delay=" + b.delay
+	}
+	return label
+}
+
+func runTc(args ...string) error {
+	output, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// The device packets to ip leave through.
+func routeDevice(ip net.IP) (string, error) {
+	output, err := exec.Command("ip", "-o", "route", "get", ip.String()).Output()
+	if err != nil {
+		return "", fmt.Errorf("ip route get %s: %s", ip, err)
+	}
+	fields := strings.Fields(string(output))
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no route to %s", ip)
+}
+
+// The root qdisc of device if it was installed, empty if it's the kernel's default.
+func installedRootQdisc(device string) (string, error) {
+	output, err := exec.Command("tc", "qdisc", "show", "dev", device, "root").Output()
+	if err != nil {
+		return "", fmt.Errorf("tc qdisc show dev %s root: %s", device, err)
+	}
+	// qdisc <kind> <handle> root ..., the kernel's own having handle 0:
+	fields := strings.Fields(string(output))
+	if len(fields) >= 3 && fields[2] != "0:" {
+		return strings.TrimSpace(string(output)), nil
+	}
+	return "", nil
+}
+
+// Put the bottleneck on packets to the ports of host, returning how to take it off.
+func (b *bottleneckSettings) install(host string, ports []int) (func() error, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate.To4()
+			break
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("bottleneck: %s has no IPv4 address", host)
+	}
+	device, err := routeDevice(ip)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := installedRootQdisc(device)
+	if err != nil {
+		return nil, err
+	}
+	if existing != "" {
+		return nil, fmt.Errorf("bottleneck: %s already has a root qdisc (%s), take it off or leave out -bottleneck", device, existing)
+	}
+
+	remove := func() error {
+		return runTc("qdisc", "del", "dev", device, "root")
+	}
+	commands := [][]string{
+		{"qdisc", "add", "dev", device, "root", "handle", "1:", "htb"},
+		{"class", "add", "dev", device, "parent", "1:", "classid", "1:1", "htb", "rate", b.rate, "ceil", b.rate},
+	}
+	queueParent := "1:1"
+	if b.delay != "" {
+		commands = append(commands, []string{"qdisc", "add", "dev", device, "parent", "1:1", "handle", "10:", "netem", "delay", b.delay, "limit", "100000"})
+		queueParent = "10:1"
+	}
+	commands = append(commands, []string{"qdisc", "add", "dev", device, "parent", queueParent, "handle", "20:", "bfifo", "limit", strconv.Itoa(b.queue)})
+	for _, port := range ports {
+		commands = append(commands, []string{"filter", "add", "dev", device, "parent", "1:", "protocol", "ip", "u32",
+			"match", "ip", "dst", ip.String() + "/32", "match", "ip", "dport", strconv.Itoa(port), "0xffff", "flowid", "1:1"})
+	}
+
+	for i, command := range commands {
+		if err := runTc(command...); err != nil {
+			if i > 0 {
+				remove()
+			}
+			return nil, err
+		}
+	}
+	fmt.Printf("Bottleneck %s on %s to %s, ports %v\n", b, device, ip, ports)
+	return remove, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The largest single Write of the raw, gRPC streaming and WebTransport floods.
+// The -chunkSize flag takes a list of sizes to sweep, like the QUIC knobs; the
+// server's read buffer and reuse strategy are flags of the server, recorded
+// with every result next to it (see server/buffers.go).
+var writeChunkSize = bufferMaxSize
+
+// The server's buffer settings as it reported them, recorded with results.
+var serverBufferTuning = "unknown"
+
+func parseChunkSizes(spec string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(spec, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid chunk size %q", field)
+		}
+		if size > finalMessageSize {
+			return nil, fmt.Errorf("chunk size %d is larger than the largest transfer (%d)", size, finalMessageSize)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// Print the CPU time the server spent over a sweep point, and append it to the sweep file of the environment
+func reportSweepPoint(environment string, duration time.Duration, serverCpu time.Duration) {
+	fmt.Printf("[Sweep - %s] %s, server CPU: %s (%.1f%%)\n", environment, duration, serverCpu, 100*serverCpu.Seconds()/duration.Seconds())
+
+	fileName := outputFile("sweep", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%d,%d", environment, duration.Milliseconds(), serverCpu.Milliseconds()))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
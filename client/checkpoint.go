@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A campaign is every measurement of every run of the main loop, a
+// measurement being one test over one protocol, all its sizes included. A
+// measurement that fails no longer ends the campaign: the error is printed,
+// the rest goes on, and the client exits with an error at the end. With
+// -checkpoint the measurements completed so far are saved after each one, and
+// running the same command again resumes the campaign, skipping them. Every
+// row of the reports ends with the campaign and measurement it was written by,
+// so a measurement that was interrupted has its rows dropped before it runs
+// again from the start.
+type campaignProgress struct {
+	file string // none if empty
+
+	Campaign string   `json:"campaign"` // when the campaign started, naming it in the rows
+	Args     []string `json:"args"`     // of the campaign, which must be those of a resume
+	Done     []string `json:"done"`     // as run/index, index counting the measurements of the run
+
+	done    map[string]bool
+	run     int
+	index   int
+	skipped int
+	failed  []string
+}
+
+// The progress saved in file, or a new campaign if there is no file yet.
+func loadProgress(file string, args []string) (*campaignProgress, error) {
+	p := &campaignProgress{file: file, Campaign: time.Now().UTC().Format("20060102T150405"), Args: args, done: make(map[string]bool)}
+	if file == "" {
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &campaignProgress{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if strings.Join(saved.Args, " ") != strings.Join(args, " ") {
+		return nil, fmt.Errorf("%s is the checkpoint of a campaign with other flags (%s), remove it to start a new one", file, strings.Join(saved.Args, " "))
+	}
+	p.Done = saved.Done
+	for _, key := range saved.Done {
+		p.done[key] = true
+	}
+	fmt.Printf("Resuming the campaign of %s, %d measurements done\n", file, len(p.Done))
+	if saved.Campaign != "" {
+		p.Campaign = saved.Campaign
+		if err := p.dropStaleRows(outputDir); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Remove from the reports in dir the rows of measurements of the campaign that
+// were not completed, and a last row that was cut short, as they run again.
+func (p *campaignProgress) dropStaleRows(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return err
+	}
+	prefix := p.Campaign + "/"
+	dropped := 0
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var kept strings.Builder
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			row := strings.TrimSuffix(line, "\n")
+			key := row[strings.LastIndex(row, ",")+1:]
+			if (strings.HasPrefix(key, prefix) && !p.done[strings.TrimPrefix(key, prefix)]) || (line != "" && row == line) {
+				dropped++
+				continue
+			}
+			kept.WriteString(line)
+		}
+		if kept.Len() == len(data) {
+			continue
+		}
+		if err := ioutil.WriteFile(file+".tmp", []byte(kept.String()), 0777); err != nil {
+			return err
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return err
+		}
+	}
+	if dropped > 0 {
+		fmt.Printf("Dropped %d rows of measurements that were interrupted\n", dropped)
+	}
+	return nil
+}
+
+// Write the progress next to the file first, so an interruption never leaves half of it.
+func (p *campaignProgress) save() error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.file+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(p.file+".tmp", p.file)
+}
+
+func (p *campaignProgress) startRun(run int) {
+	p.run = run
+	p.index = 0
+}
+
+// Run the next measurement of the run, unless it's done already.
+func (p *campaignProgress) measure(name string, measurement func() error) {
+	key := fmt.Sprintf("%d/%d", p.run, p.index)
+	p.index++
+	if p.done[key] {
+		p.skipped++
+		fmt.Printf("Skipping %s of run %d, done before\n", name, p.run)
+		return
+	}
+
+	measurementColumn = p.Campaign + "/" + key
+	defer func() { measurementColumn = "-" }()
+	if err := runMeasurement(measurement); err != nil {
+		fmt.Printf("%s of run %d failed: %s\n", name, p.run, err)
+		p.failed = append(p.failed, fmt.Sprintf("%s of run %d", name, p.run))
+		return
+	}
+	p.done[key] = true
+	p.Done = append(p.Done, key)
+	if p.file != "" {
+		if err := p.save(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// The measurement the rows being written belong to, as campaign/run/index, the last column of every row.
+var measurementColumn = "-"
+
+// Run a measurement, turning a panic into its error.
+func runMeasurement(measurement func() error) (err error) {
+	defer recoverError(&err)
+	return measurement()
+}
+
+// Run a worker of a measurement on a goroutine of its own, the channel getting
+// what it returns. A panic can only be recovered on the goroutine it happens on,
+// so the worker's is turned into its error here rather than ending the campaign.
+func goWorker(worker func() error) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { result <- err }()
+		defer recoverError(&err)
+		err = worker()
+	}()
+	return result
+}
+
+// Wait for every worker, returning the first error.
+func waitWorkers(workers []<-chan error) error {
+	var firstErr error
+	for _, worker := range workers {
+		if err := <-worker; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
+
+// Say how the campaign went, exiting with an error if any measurement failed.
+func (p *campaignProgress) finish() {
+	if p.skipped > 0 {
+		fmt.Printf("Skipped %d measurements done before\n", p.skipped)
+	}
+	if len(p.failed) == 0 {
+		return
+	}
+	fmt.Printf("%d measurements failed:\n", len(p.failed))
+	for _, failed := range p.failed {
+		fmt.Printf("  %s\n", failed)
+	}
+	if p.file != "" {
+		fmt.Printf("Run the same command again to retry them, %s keeps what's done\n", p.file)
+	}
+	os.Exit(1)
+}
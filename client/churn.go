@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Connection churn opens and closes connections as fast as a few callers can,
+// each connection optionally carrying one small request, to find how many
+// handshakes a second a server sustains and what each one costs it. TCP, TLS
+// and QUIC connect to the RPC servers (see rpc.go), HTTP/3 to the HTTP/3 server.
+// TLS sessions are never resumed, so every connection is a full handshake.
+// HTTP/3 connections always make a request, of no bytes if there is none, so
+// they set up HTTP/3 (control and QPACK streams, SETTINGS) and aren't just QUIC.
+type churnConfig struct {
+	requestSize int // bytes each way of the request on every connection, 0 for none
+	concurrency int
+	duration    time.Duration
+}
+
+// Open one connection to addr over protocol, run the request if any, and close it.
+func churnConnection(protocol string, addr string, requestSize int) error {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+
+	switch protocol {
+	case rpcTcp, rpcTcpTls:
+		tcpConn, err := tcpTuning.dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		// Reset instead of lingering in TIME_WAIT, or the client runs out of ports long before the server gives up.
+		if tcp, ok := tcpConn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn := tcpConn
+		if protocol == rpcTcpTls {
+			tlsConn := tls.Client(tcpConn, tlsConf)
+			if err := tlsConn.Handshake(); err != nil {
+				tcpConn.Close()
+				return err
+			}
+			conn = tlsConn
+		}
+		defer conn.Close()
+
+		if requestSize == 0 {
+			return nil
+		}
+		if err := writeRpcRequest(conn, requestSize, requestSize); err != nil {
+			return err
+		}
+		_, err = io.CopyN(ioutil.Discard, conn, int64(requestSize))
+		return err
+	case rpcQuic:
+		session, err := quicImplementation.dial(addr, tlsConf, quicTuning.options(quicOptions{}))
+		if err != nil {
+			return err
+		}
+		defer session.CloseWithError(0, "")
+
+		if requestSize == 0 {
+			return nil
+		}
+		stream, err := session.OpenStreamSync(context.Background())
+		if err != nil {
+			return err
+		}
+		if err := writeRpcRequest(stream, requestSize, requestSize); err != nil {
+			return err
+		}
+		stream.Close()
+		_, err = io.CopyN(ioutil.Discard, stream, int64(requestSize))
+		return err
+	case httpVariantHttp3:
+		transport := quicImplementation.http3Transport(tlsConf, quicTuning.options(quicOptions{}))
+		if closer, ok := transport.(io.Closer); ok {
+			defer closer.Close()
+		}
+		response, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://%s/bytes/%d", addr, requestSize))
+		if err != nil {
+			return err
+		}
+		return readHttpBody(response, requestSize)
+	}
+	return fmt.Errorf("unknown churn protocol %q", protocol)
+}
+
+// Append a churn run to the churn file of the environment
+func reportChurn(protocol string, environment string, config *churnConfig, handshakes int, failures int, duration time.Duration, cpuPerHandshake time.Duration) {
+	rate := float64(handshakes) / duration.Seconds()
+	failureRate := 0.0
+	if handshakes+failures > 0 {
+		failureRate = float64(failures) / float64(handshakes+failures)
+	}
+	fmt.Printf("[%s - %s] %d connections, %.1f handshakes/s, failure rate: %.2f%%, server CPU per handshake: %s\n", protocol, environment, handshakes, rate, failureRate*100, cpuPerHandshake)
+
+	fileName := outputFile("churn", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%d,%d,", protocol, environment, config.requestSize, config.concurrency))
+	f.WriteString(fmt.Sprintf("%d,%d,%f,%f,", handshakes, failures, rate, failureRate))
+	f.WriteString(fmt.Sprintf("%d", cpuPerHandshake.Microseconds()))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
+
+// Churn connections over one protocol for the configured duration. httpPort is where the server's stats are read.
+func clientChurnMain(environment string, host string, port int, httpPort int, protocol string, config *churnConfig) error {
+	fmt.Printf("Testing %s connection churn (%d callers, %s requests)...\n", protocol, config.concurrency, getSizeString(config.requestSize))
+	protocolName := fmt.Sprintf("%s Churn", protocol) // for report and logging strings
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	failures := 0
+	var firstErr error
+
+	statsBefore, errBefore := fetchServerStats(host, httpPort, false)
+	var workers []<-chan error
+	start := time.Now()
+	for i := 0; i < config.concurrency; i++ {
+		workers = append(workers, goWorker(func() error {
+			for time.Since(start) < config.duration {
+				connectionStart := time.Now()
+				err := churnConnection(protocol, addr, config.requestSize)
+				latency := time.Since(connectionStart)
+
+				mu.Lock()
+				if err != nil {
+					failures++
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+			return nil
+		}))
+	}
+	if err := waitWorkers(workers); err != nil {
+		return err
+	}
+	duration := time.Since(start)
+	statsAfter, errAfter := fetchServerStats(host, httpPort, false)
+
+	if firstErr != nil {
+		fmt.Printf("[%s - %s] %d connections failed, first error: %s\n", protocolName, environment, failures, firstErr)
+	}
+	cpuPerHandshake := time.Duration(-1) // unknown
+	if errBefore == nil && errAfter == nil && len(latencies)+failures > 0 {
+		cpuPerHandshake = (statsAfter.cpuTime() - statsBefore.cpuTime()) / time.Duration(len(latencies)+failures)
+	}
+	reportChurn(protocolName, environment, config, len(latencies), failures, duration, cpuPerHandshake)
+	reportLatencies(protocolName, environment, "Connection", config.requestSize, latencies, duration)
+	if len(latencies) == 0 {
+		return firstErr
+	}
+	return nil
+}
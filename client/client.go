@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"golang.org/x/net/http2"
@@ -16,12 +17,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
-	"sync"
 	"time"
 
-	"github.com/lucas-clemente/quic-go" // my go extension did this everytime I hit save.
-	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/mackerelio/go-osstat/cpu"
 	"github.com/mackerelio/go-osstat/memory"
 )
@@ -35,6 +34,13 @@ const sampleSizes = 5             // The number of times each experiment is exec
 var dataBuffer []byte = nil
 var httpByteBuffer [][]byte = nil
 
+// Where reports go, one CSV file per kind of report and environment.
+var outputDir = "/var/log/output"
+
+func outputFile(kind string, environment string) string {
+	return filepath.Join(outputDir, fmt.Sprintf("%s_%s.csv", kind, environment))
+}
+
 func getSizeString(size int) string {
 	newSize := float64(size)
 	unit := "b"
@@ -48,17 +54,36 @@ func getSizeString(size int) string {
 	return fmt.Sprintf("%.0f %s", newSize, unit)
 }
 
+// The setup of rows that have none of their own to report, left empty in the CSV.
+const noSetup time.Duration = -1
+
 func report(protocol string, environment string, kind string, filesToSend int, setupDuration time.Duration, firstByteDuration time.Duration, size int,
 	duration time.Duration, memoryBefore *memory.Stats, memoryAfter *memory.Stats, cpuBefore *cpu.Stats, cpuAfter *cpu.Stats) {
+	reportDelivered(protocol, environment, kind, filesToSend, setupDuration, firstByteDuration, size, duration, size*filesToSend, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+}
+
+// Like report, for transports that may lose data: goodput only counts the acknowledged bytes,
+// and the row records them with the share of what was sent they make up.
+func reportDelivered(protocol string, environment string, kind string, filesToSend int, setupDuration time.Duration, firstByteDuration time.Duration, size int,
+	duration time.Duration, acknowledged int, memoryBefore *memory.Stats, memoryAfter *memory.Stats, cpuBefore *cpu.Stats, cpuAfter *cpu.Stats) {
 
 	fileSizeStr := getSizeString(size)
-	goodput := (float64(size) / duration.Seconds()) * float64(filesToSend)
+	goodput := float64(acknowledged) / duration.Seconds()
+	deliveryRatio := float64(acknowledged) / float64(size*filesToSend)
+
+	setupStr, setupColumn := setupDuration.String(), strconv.FormatInt(setupDuration.Microseconds(), 10)
+	if setupDuration == noSetup {
+		setupStr, setupColumn = "-", ""
+	}
 
-	fmt.Printf("[%s - %s] [%d files] setup: %s, firstbyte: %s, sent: %s, duration: %s (goodput: %.0f kbps)\n", protocol, environment, filesToSend, setupDuration, firstByteDuration, fileSizeStr, duration, goodput/1024.0)
+	fmt.Printf("[%s - %s] [%d files] setup: %s, firstbyte: %s, sent: %s, duration: %s (goodput: %.0f kbps)\n", protocol, environment, filesToSend, setupStr, firstByteDuration, fileSizeStr, duration, goodput/1024.0)
+	if deliveryRatio < 1 {
+		fmt.Printf("[%s - %s] %d of %d bytes acknowledged (%.2f%%)\n", protocol, environment, acknowledged, size*filesToSend, 100*deliveryRatio)
+	}
 
 	if size >= 32 {
 
-		fileName := fmt.Sprintf("/var/log/output/meter_%s.csv", environment)
+		fileName := outputFile("meter", environment)
 
 		f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
 		if err != nil {
@@ -73,10 +98,12 @@ func report(protocol string, environment string, kind string, filesToSend int, s
 
 		// environment
 		f.WriteString(fmt.Sprintf("%s,%s,%s,%d,", protocol, kind, environment, filesToSend))
-		f.WriteString(fmt.Sprintf("%d,%d,", setupDuration.Microseconds(), firstByteDuration.Microseconds()))
+		f.WriteString(fmt.Sprintf("%s,%d,", setupColumn, firstByteDuration.Microseconds()))
 		f.WriteString(fmt.Sprintf("%s,%d,%f,", fileSizeStr, duration.Microseconds(), goodput))
 		f.WriteString(fmt.Sprintf("%d,%d,%d,", cpuUser, cpuSystem, cpuTotal))
-		f.WriteString(fmt.Sprintf("%d,%d", int(memoryDiff/1048576.0), int(memoryAfter.Used/1048576.0)))
+		f.WriteString(fmt.Sprintf("%d,%d,", int(memoryDiff/1048576.0), int(memoryAfter.Used/1048576.0)))
+		f.WriteString(fmt.Sprintf("%d,%f", acknowledged, deliveryRatio))
+		f.WriteString(settingsColumns())
 		f.WriteString("\n")
 	}
 }
@@ -86,6 +113,7 @@ func report(protocol string, environment string, kind string, filesToSend int, s
 func main() {
 	host := flag.String("host", "localhost", "Host to connect")
 	environment := flag.String("env", "Local", "Environment name")
+	output := flag.String("output", outputDir, "Directory to write the reports to")
 
 	quicPort := flag.Int("quic", 4242, "QUIC port to connect")
 	tcpPort := flag.Int("tcp", 4243, "TCP port to connect")
@@ -93,10 +121,233 @@ func main() {
 	httpPort := flag.Int("http", 4245, "HTTP port to connect")
 	httpsPort := flag.Int("https", 4246, "HTTPS port to connect")
 	http3Port := flag.Int("http3", 4247, "HTTP3 port to connect")
+	webTransportPort := flag.Int("webtransport", 4248, "WebTransport (HTTP/3) port to connect")
+	webSocketH2Port := flag.Int("websocketH2", 4249, "WebSocket over HTTP/2 (RFC 8441) port to connect")
+	grpcPort := flag.Int("grpc", 4250, "gRPC (HTTP/2) port to connect")
+	grpcHttp3Port := flag.Int("grpcHttp3", 4251, "gRPC over HTTP3 port to connect")
+	rpcTcpPort := flag.Int("rpcTcp", 4252, "RPC over TCP port to connect")
+	rpcTcpTlsPort := flag.Int("rpcTcpTls", 4253, "RPC over TCP TLS port to connect")
+	rpcQuicPort := flag.Int("rpcQuic", 4254, "RPC over QUIC port to connect")
+	migrationPort := flag.Int("migration", 4255, "RPC over QUIC port of the server that follows address changes")
+	migrationSize := flag.Int("migrationSize", 33554432, "Bytes downloaded while changing address halfway in the migration benchmark")
+	rpcRequest := flag.String("rpcRequest", "exp:1024", "RPC request sizes: fixed:<n>, uniform:<min>-<max>, exp:<mean> or cdf:<file>")
+	rpcResponse := flag.String("rpcResponse", "exp:16384", "RPC response sizes, same forms as -rpcRequest")
+	rpcRate := flag.Float64("rpcRate", 0, "RPCs per second sent open-loop, closed-loop if 0")
+	rpcArrivals := flag.String("rpcArrivals", arrivalsConstant, "Spacing of open-loop RPCs: constant or poisson")
+	rpcConcurrency := flag.Int("rpcConcurrency", 8, "Concurrent RPC callers when closed-loop")
+	rpcDuration := flag.Int("rpcDuration", 10, "Seconds to run the RPC workload for, per protocol")
+	churnRequest := flag.Int("churnRequest", 0, "Bytes each way of the request made on every churned connection, none if 0 (HTTP/3 then asks for 0 bytes)")
+	churnConcurrency := flag.Int("churnConcurrency", 16, "Callers opening connections concurrently in the churn benchmark")
+	churnDuration := flag.Int("churnDuration", 10, "Seconds to churn connections for, per protocol")
+	idleConnections := flag.String("idleConnections", "100,500,1000,2000", "Comma separated counts of idle connections to hold, per protocol")
+	idleHold := flag.Int("idleHold", 10, "Seconds to hold each count of idle connections for before sampling memory")
+	quicKnobFlags := quicFlags()
+	tcpNoDelay := flag.Bool("tcpNoDelay", true, "Set TCP_NODELAY on TCP connections")
+	tcpSendBuffer := flag.Int("tcpSendBuffer", 0, "SO_SNDBUF of TCP connections in bytes, the kernel's default if 0")
+	tcpReceiveBuffer := flag.Int("tcpReceiveBuffer", 0, "SO_RCVBUF of TCP connections in bytes, the kernel's default if 0")
+	tcpCongestion := flag.String("tcpCongestion", "", "TCP congestion control algorithm (cubic, bbr, reno...), the kernel's default if empty")
+	tcpFastOpen := flag.Bool("tcpFastOpen", false, "Use TCP Fast Open on TCP connections")
+	udpReceiveBuffer := flag.Int("udpReceiveBuffer", 0, "SO_RCVBUF of QUIC sockets in bytes, quic-go's 2 MB if 0")
+	udpSendBuffer := flag.Int("udpSendBuffer", 0, "SO_SNDBUF of QUIC sockets in bytes, the kernel's default if 0")
+	udpEcn := flag.Bool("udpEcn", true, "Let quic-go read ECN bits and packet info of incoming packets")
+	chunkSize := flag.String("chunkSize", strconv.Itoa(bufferMaxSize), "Comma separated sizes of the largest single write of floods to sweep, in bytes")
+	interop := flag.String("interop", "", "Base URL (http:// or https://) of any HTTP server to run the interop downloads and uploads against instead of the other tests")
+	interopDownload := flag.String("interopDownload", "/bytes/{size}", "Path of interop downloads, {size} is replaced by the bytes asked for")
+	interopUpload := flag.String("interopUpload", "/upload", "Path interop uploads are POSTed to, no uploads if empty")
+	interopSizes := flag.String("interopSizes", "1024,1048576,16777216", "Comma separated sizes of interop transfers, in bytes")
+	interopProtocols := flag.String("interopProtocols", "h1,h2,h3", "Comma separated HTTP versions of interop transfers: h1, h2 and, over https, h3")
+	quicBackendName := flag.String("quicBackend", builtinQuicBackend, "QUIC implementation the QUIC and HTTP/3 tests run on")
+	quicScenario := flag.String("quicScenario", "", "JSON file mapping QUIC knobs to lists of values to sweep, overriding the -quic flags")
+	pageFile := flag.String("page", "", "Page manifest (JSON) to replay for page loads, a built-in page if empty")
+	harFile := flag.String("importHar", "", "Convert a HAR file into the page manifest at -page (stdout if empty), then exit")
+	checkpoint := flag.String("checkpoint", "", "File keeping the measurements done, to resume an interrupted campaign by running the same command again")
+	sampleMillis := flag.Int("transferSample", 0, "Milliseconds between samples of the bytes every flood has moved, written to series_<env>.csv, none if 0")
+	fanIn := flag.String("fanIn", "", "Clients per protocol flooding the server at once, like quic:4,tcp:4 (protocols quic, tcp and tcpTls), no fan-in test if empty")
+	fanInDuration := flag.Int("fanInDuration", 10, "Seconds the fan-in clients flood for")
+	fanInProcesses := flag.Bool("fanInProcesses", false, "Run every fan-in client in a process of its own instead of a goroutine")
+	fanInSample := flag.Int("fanInSample", 0, "Milliseconds between samples of what every fan-in client got, written to fanin_series_<env>.csv, none if 0")
+	bottleneck := flag.String("bottleneck", "", "Bottleneck fan-in flows share, set up with tc on the route to the server, like rate=20mbit,delay=20ms,queue=262144 (needs root), none if empty")
+	fanInWorker := flag.String("fanInWorker", "", "Run one fan-in client described in JSON, as a process started by -fanInProcesses")
+	agent := flag.String("agent", "", "Listen on this address for a controller to run the client or server for, instead of running tests")
+	agentToken := flag.String("agentToken", "", "Secret shared by a controller and its agents, which reject controllers without it")
+	agentServer := flag.String("agentServer", "/server/goquic-server", "Server binary an agent runs when given the server role")
+	controller := flag.String("controller", "", "Scenario (JSON) to run on agents, collecting their results under -controllerOutput, instead of running tests")
+	controllerOutput := flag.String("controllerOutput", "", "Directory of controller runs, runs under -output if empty")
 	flag.Parse()
+	outputDir = *output
+	transferSample = time.Duration(*sampleMillis) * time.Millisecond
+	if errOutput := os.MkdirAll(outputDir, 0777); errOutput != nil {
+		panic(errOutput)
+	}
+
+	if *agent != "" {
+		if errAgent := agentMain(*agent, *agentServer, *agentToken); errAgent != nil {
+			panic(errAgent)
+		}
+		return
+	}
+	if *controller != "" {
+		if *controllerOutput == "" {
+			*controllerOutput = filepath.Join(outputDir, "runs")
+		}
+		if errController := controllerMain(*controller, *controllerOutput, *agentToken); errController != nil {
+			fmt.Println(errController)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *harFile != "" {
+		manifest, errHar := importHar(*harFile)
+		if errHar != nil {
+			panic(errHar)
+		}
+		errHar = writePageManifest(manifest, *pageFile)
+		if errHar != nil {
+			panic(errHar)
+		}
+		fmt.Fprintf(os.Stderr, "Converted %d requests of %s (%s)\n", len(manifest.Resources), *harFile, getSizeString(manifest.totalSize()))
+		return
+	}
+
+	page, errPage := loadPageManifest(*pageFile)
+	if errPage != nil {
+		panic(errPage)
+	}
+
+	rpcRequestSizes, errRpc := parseSizeDistribution(*rpcRequest)
+	if errRpc != nil {
+		panic(errRpc)
+	}
+	rpcResponseSizes, errRpc := parseSizeDistribution(*rpcResponse)
+	if errRpc != nil {
+		panic(errRpc)
+	}
+	if errRpc = validArrivals(*rpcArrivals); errRpc != nil {
+		panic(errRpc)
+	}
+	rpc := &rpcConfig{
+		requestSizes:  rpcRequestSizes,
+		responseSizes: rpcResponseSizes,
+		rate:          *rpcRate,
+		arrivals:      *rpcArrivals,
+		concurrency:   *rpcConcurrency,
+		duration:      time.Duration(*rpcDuration) * time.Second,
+	}
+	churn := &churnConfig{
+		requestSize: *churnRequest,
+		concurrency: *churnConcurrency,
+		duration:    time.Duration(*churnDuration) * time.Second,
+	}
+	idleSteps, errIdle := parseIdleSteps(*idleConnections)
+	if errIdle != nil {
+		panic(errIdle)
+	}
+	raiseFileLimit()
+
+	tcpTuning = &tcpSettings{
+		noDelay:       *tcpNoDelay,
+		sendBuffer:    *tcpSendBuffer,
+		receiveBuffer: *tcpReceiveBuffer,
+		congestion:    *tcpCongestion,
+		fastOpen:      *tcpFastOpen,
+	}
+	if errTcp := tcpTuning.check(); errTcp != nil {
+		panic(errTcp)
+	}
+	udpTuning = &udpSettings{
+		receiveBuffer: *udpReceiveBuffer,
+		sendBuffer:    *udpSendBuffer,
+		ecn:           *udpEcn,
+	}
+	if errUdp := udpTuning.check(); errUdp != nil {
+		panic(errUdp)
+	}
+
+	if errBackend := selectQuicBackend(*quicBackendName); errBackend != nil {
+		panic(errBackend)
+	}
+
+	var interopTarget *interopConfig
+	if *interop != "" {
+		var errInterop error
+		interopTarget, errInterop = parseInteropConfig(*interop, *interopDownload, *interopUpload, *interopSizes, *interopProtocols)
+		if errInterop != nil {
+			panic(errInterop)
+		}
+	}
+
+	sweep, errSweep := quicSweep(quicKnobFlags, *quicScenario)
+	if errSweep != nil {
+		panic(errSweep)
+	}
+	chunkSizes, errSweep := parseChunkSizes(*chunkSize)
+	if errSweep != nil {
+		panic(errSweep)
+	}
+
+	var fanInTest *fanInConfig
+	if *bottleneck != "" && *fanIn == "" {
+		panic("-bottleneck applies to fan-in runs, which need -fanIn")
+	}
+	if *fanIn != "" {
+		var errFanIn error
+		var fanInBottleneck *bottleneckSettings
+		if *bottleneck != "" {
+			if fanInBottleneck, errFanIn = parseBottleneck(*bottleneck); errFanIn != nil {
+				panic(errFanIn)
+			}
+		}
+		fanInTest, errFanIn = parseFanIn(*fanIn, time.Duration(*fanInDuration)*time.Second, *fanInProcesses, fanInBottleneck, time.Duration(*fanInSample)*time.Millisecond)
+		if errFanIn != nil {
+			panic(errFanIn)
+		}
+	}
+	fanInPorts := map[string]int{fanInQuic: *quicPort, fanInTcp: *tcpPort, fanInTcpTls: *tcpTlsPort}
 
-	// Run the loops a bunch of times
-	for i := 0; i < sampleSizes; i++ {
+	if *fanInWorker != "" {
+		job := &fanInJob{}
+		if errFanIn := json.Unmarshal([]byte(*fanInWorker), job); errFanIn != nil {
+			panic(errFanIn)
+		}
+		quicTuning = sweep[job.Point/len(chunkSizes)]
+		writeChunkSize = chunkSizes[job.Point%len(chunkSizes)]
+		dataBuffer = make([]byte, writeChunkSize)
+		rand.Read(dataBuffer)
+		printFanInResult(runFanInJob(job))
+		return
+	}
+
+	progress, errProgress := loadProgress(*checkpoint, os.Args[1:])
+	if errProgress != nil {
+		panic(errProgress)
+	}
+
+	// Run the loops a bunch of times, for every combination of QUIC settings and chunk size
+	var pointStart time.Time
+	var pointStats *processStats
+	for run := 0; run < len(sweep)*len(chunkSizes)*sampleSizes; run++ {
+		progress.startRun(run)
+		if run%sampleSizes == 0 {
+			point := run / sampleSizes
+			quicTuning = sweep[point/len(chunkSizes)]
+			writeChunkSize = chunkSizes[point%len(chunkSizes)]
+			stats, errStats := fetchServerStats(*host, *httpPort, false)
+			if errStats == nil && interopTarget == nil {
+				serverQuicTuning = stats.Quic
+				serverTcpTuning = stats.Tcp
+				serverBufferTuning = stats.Buffers
+				serverUdpTuning = stats.Udp
+				serverUdpEffective = stats.UdpEffective
+				serverQuicImplementation = stats.QuicImplementation
+			}
+			pointStart, pointStats = time.Now(), stats
+			fmt.Printf("QUIC implementation: %s (server: %s)\n", quicImplementation, serverQuicImplementation)
+			fmt.Printf("QUIC settings: %s (server: %s)\n", quicTuning, serverQuicTuning)
+			fmt.Printf("TCP settings: %s (server: %s)\n", tcpTuning, serverTcpTuning)
+			fmt.Printf("Chunk size: %d (server buffers: %s)\n", writeChunkSize, serverBufferTuning)
+			fmt.Printf("UDP settings: %s (server: %s, %s)\n", udpTuning, serverUdpTuning, serverUdpEffective)
+		}
 
 		// Set up random data to send.
 		dataBuffer = make([]byte, finalMessageSize)
@@ -120,80 +371,295 @@ func main() {
 			i++
 		}
 
+		if interopTarget != nil {
+			progress.measure("clientInteropMain", func() error {
+				return clientInteropMain(*environment, interopTarget)
+			})
+			continue
+		}
+
 		fmt.Printf("Starting clients to reach %s...\n", *host)
 
 		// Run QUIC first, early feedback on UDP connections
 		if *quicPort > 0 {
-			errQuic := clientQuicMain(*environment, *host, *quicPort)
-			if errQuic != nil {
-				panic(errQuic)
-			}
+			progress.measure("clientQuicMain", func() error {
+				return clientQuicMain(*environment, *host, *quicPort)
+			})
 		}
 
 		// HTTP-related tests
 		if *httpPort > 0 {
-			errHttp := clientHttpMain(*environment, *host, *httpPort)
-			if errHttp != nil {
-				panic(errHttp)
+			progress.measure("clientHttpMain", func() error {
+				return clientHttpMain(*environment, *host, *httpPort, false)
+			})
+
+			for _, connections := range []int{2, 4, 8} {
+				progress.measure("clientHttp1Main", func() error {
+					return clientHttp1Main(*environment, *host, *httpPort, false, httpPool, connections)
+				})
 			}
+			progress.measure("clientHttp1Main", func() error {
+				return clientHttp1Main(*environment, *host, *httpPort, false, httpNoKeepAlive, 1)
+			})
+			progress.measure("clientHttp1Main", func() error {
+				return clientHttp1Main(*environment, *host, *httpPort, false, httpPipelining, 1)
+			})
+
+			// Cleartext HTTP/2 on the same port, to separate framing from encryption
+			progress.measure("clientH2cMain", func() error {
+				return clientH2cMain(*environment, *host, *httpPort, false, false, filesToSend)
+			})
+			progress.measure("clientH2cMain", func() error {
+				return clientH2cMain(*environment, *host, *httpPort, true, false, filesToSend)
+			})
+
+			progress.measure("clientH2cMain", func() error {
+				return clientH2cMain(*environment, *host, *httpPort, false, true, 2)
+			})
+			progress.measure("clientH2cMain", func() error {
+				return clientH2cMain(*environment, *host, *httpPort, false, true, 4)
+			})
+			progress.measure("clientH2cMain", func() error {
+				return clientH2cMain(*environment, *host, *httpPort, false, true, 8)
+			})
 		}
 
 		if *httpsPort > 0 {
-			errHttps := clientHttpsMain(*environment, *host, *httpsPort, false, filesToSend)
-			if errHttps != nil {
-				panic(errHttps)
+			progress.measure("clientHttpMain", func() error {
+				return clientHttpMain(*environment, *host, *httpsPort, true)
+			})
+
+			for _, connections := range []int{2, 4, 8} {
+				progress.measure("clientHttp1Main", func() error {
+					return clientHttp1Main(*environment, *host, *httpsPort, true, httpPool, connections)
+				})
 			}
+			progress.measure("clientHttp1Main", func() error {
+				return clientHttp1Main(*environment, *host, *httpsPort, true, httpNoKeepAlive, 1)
+			})
+			progress.measure("clientHttp1Main", func() error {
+				return clientHttp1Main(*environment, *host, *httpsPort, true, httpPipelining, 1)
+			})
+
+			progress.measure("clientHttpsMain", func() error {
+				return clientHttpsMain(*environment, *host, *httpsPort, false, filesToSend)
+			})
+
+			progress.measure("clientHttpsMain", func() error {
+				return clientHttpsMain(*environment, *host, *httpsPort, true, 2)
+			})
+			progress.measure("clientHttpsMain", func() error {
+				return clientHttpsMain(*environment, *host, *httpsPort, true, 4)
+			})
+			progress.measure("clientHttpsMain", func() error {
+				return clientHttpsMain(*environment, *host, *httpsPort, true, 8)
+			})
+		}
+
+		// WebSocket tests, upgraded from the HTTP and HTTPS servers
+		if *httpPort > 0 {
+			progress.measure("clientWebSocketMain", func() error {
+				return clientWebSocketMain(*environment, *host, *httpPort, webSocketHttp)
+			})
+		}
+
+		if *httpsPort > 0 {
+			progress.measure("clientWebSocketMain", func() error {
+				return clientWebSocketMain(*environment, *host, *httpsPort, webSocketHttpTls)
+			})
+		}
 
-			errHttpsMult := clientHttpsMain(*environment, *host, *httpsPort, true, 2)
-			if errHttpsMult != nil {
-				panic(errHttpsMult)
+		if *webSocketH2Port > 0 {
+			progress.measure("clientWebSocketMain", func() error {
+				return clientWebSocketMain(*environment, *host, *webSocketH2Port, webSocketHttp2)
+			})
+		}
+
+		if *http3Port > 0 {
+			progress.measure("clientHttp3Main", func() error {
+				return clientHttp3Main(*environment, *host, *http3Port, false, filesToSend)
+			})
+
+			progress.measure("clientHttp3Main", func() error {
+				return clientHttp3Main(*environment, *host, *http3Port, true, 2)
+			})
+			progress.measure("clientHttp3Main", func() error {
+				return clientHttp3Main(*environment, *host, *http3Port, true, 4)
+			})
+			progress.measure("clientHttp3Main", func() error {
+				return clientHttp3Main(*environment, *host, *http3Port, true, 8)
+			})
+		}
+
+		if *webTransportPort > 0 {
+			for _, mode := range webTransportModes {
+				progress.measure("clientWebTransportMain", func() error {
+					return clientWebTransportMain(*environment, *host, *webTransportPort, mode)
+				})
 			}
-			errHttpsMult = clientHttpsMain(*environment, *host, *httpsPort, true, 4)
-			if errHttpsMult != nil {
-				panic(errHttpsMult)
+		}
+
+		// gRPC tests
+		if *grpcPort > 0 {
+			for _, callType := range grpcCallTypes {
+				progress.measure("clientGrpcMain", func() error {
+					return clientGrpcMain(*environment, *host, *grpcPort, false, callType)
+				})
 			}
-			errHttpsMult = clientHttpsMain(*environment, *host, *httpsPort, true, 8)
-			if errHttpsMult != nil {
-				panic(errHttpsMult)
+		}
+
+		if *grpcHttp3Port > 0 {
+			for _, callType := range grpcCallTypes {
+				progress.measure("clientGrpcMain", func() error {
+					return clientGrpcMain(*environment, *host, *grpcHttp3Port, true, callType)
+				})
+			}
+		}
+
+		// Download, echo and bidirectional workloads over every HTTP version
+		workloadTargets := []struct {
+			variant string
+			port    int
+		}{
+			{httpVariantHttp1, *httpPort},
+			{httpVariantH2c, *httpPort},
+			{httpVariantHttp1Tls, *httpsPort},
+			{httpVariantHttp2, *httpsPort},
+			{httpVariantHttp3, *http3Port},
+		}
+		for _, target := range workloadTargets {
+			if target.port <= 0 {
+				continue
+			}
+			for _, workload := range httpWorkloads {
+				progress.measure("clientHttpWorkloadMain", func() error {
+					return clientHttpWorkloadMain(*environment, *host, target.port, target.variant, workload)
+				})
+			}
+		}
+
+		// Page loads over every HTTP version
+		for _, target := range workloadTargets {
+			if target.port <= 0 {
+				continue
 			}
+			progress.measure("clientPageLoadMain", func() error {
+				return clientPageLoadMain(*environment, *host, target.port, target.variant, page)
+			})
 		}
 
+		// Adaptive bitrate video over HTTP/2 and HTTP/3
+		if *httpsPort > 0 {
+			progress.measure("clientVideoMain", func() error {
+				return clientVideoMain(*environment, *host, *httpsPort, httpVariantHttp2)
+			})
+		}
 		if *http3Port > 0 {
-			errHttp3 := clientHttp3Main(*environment, *host, *http3Port, false, filesToSend)
-			if errHttp3 != nil {
-				panic(errHttp3)
+			progress.measure("clientVideoMain", func() error {
+				return clientVideoMain(*environment, *host, *http3Port, httpVariantHttp3)
+			})
+		}
+
+		// RPC workload over the raw transports and every HTTP version
+		rpcTargets := []struct {
+			protocol string
+			port     int
+		}{
+			{rpcTcp, *rpcTcpPort},
+			{rpcTcpTls, *rpcTcpTlsPort},
+			{rpcQuic, *rpcQuicPort},
+			{httpVariantHttp1, *httpPort},
+			{httpVariantH2c, *httpPort},
+			{httpVariantHttp1Tls, *httpsPort},
+			{httpVariantHttp2, *httpsPort},
+			{httpVariantHttp3, *http3Port},
+		}
+		for _, target := range rpcTargets {
+			if target.port <= 0 {
+				continue
 			}
+			progress.measure("clientRpcMain", func() error {
+				return clientRpcMain(*environment, *host, target.port, target.protocol, rpc)
+			})
+		}
 
-			errHttp3Mult := clientHttp3Main(*environment, *host, *http3Port, true, 2)
-			if errHttp3Mult != nil {
-				panic(errHttp3Mult)
+		// Connection churn, with the server's CPU read from its HTTP port
+		churnTargets := []struct {
+			protocol string
+			port     int
+		}{
+			{rpcTcp, *rpcTcpPort},
+			{rpcTcpTls, *rpcTcpTlsPort},
+			{rpcQuic, *rpcQuicPort},
+			{httpVariantHttp3, *http3Port},
+		}
+		for _, target := range churnTargets {
+			if target.port <= 0 {
+				continue
 			}
-			errHttp3Mult = clientHttp3Main(*environment, *host, *http3Port, true, 4)
-			if errHttp3Mult != nil {
-				panic(errHttp3Mult)
+			progress.measure("clientChurnMain", func() error {
+				return clientChurnMain(*environment, *host, target.port, *httpPort, target.protocol, churn)
+			})
+		}
+
+		// Idle connection scalability, with memory read from the server's HTTP port
+		for _, target := range churnTargets {
+			if target.port <= 0 {
+				continue
 			}
-			errHttp3Mult = clientHttp3Main(*environment, *host, *http3Port, true, 8)
-			if errHttp3Mult != nil {
-				panic(errHttp3Mult)
+			progress.measure("clientIdleMain", func() error {
+				return clientIdleMain(*environment, *host, target.port, *httpPort, target.protocol, idleSteps, time.Duration(*idleHold)*time.Second)
+			})
+		}
+
+		// Connection migration: QUIC moving to a new socket or behind a rebinding NAT, against TCP reconnecting
+		migrationTargets := []struct {
+			mode string
+			port int
+		}{
+			{migrationQuic, *migrationPort},
+			{migrationQuicRelay, *migrationPort},
+			{migrationTcp, *rpcTcpPort},
+		}
+		for _, target := range migrationTargets {
+			if target.port <= 0 {
+				continue
 			}
+			progress.measure("clientMigrationMain", func() error {
+				return clientMigrationMain(*environment, *host, target.port, target.mode, *migrationSize)
+			})
 		}
 
 		// Raw protocol tests
 		if *tcpPort > 0 {
-			errTcp := clientTcpMain(*environment, *host, *tcpPort)
-			if errTcp != nil {
-				panic(errTcp)
-			}
+			progress.measure("clientTcpMain", func() error {
+				return clientTcpMain(*environment, *host, *tcpPort)
+			})
 		}
 
 		if *tcpTlsPort > 0 {
-			errTcpTls := clientTcpTlsMain(*environment, *host, *tcpTlsPort)
-			if errTcpTls != nil {
-				panic(errTcpTls)
-			}
+			progress.measure("clientTcpTlsMain", func() error {
+				return clientTcpTlsMain(*environment, *host, *tcpTlsPort)
+			})
+		}
+
+		if fanInTest != nil {
+			progress.measure("clientFanInMain", func() error {
+				return clientFanInMain(*environment, *host, fanInPorts, fanInTest, run/sampleSizes)
+			})
+		}
+
+		if run%sampleSizes == sampleSizes-1 && pointStats != nil {
+			progress.measure("reportSweepPoint", func() error {
+				if stats, errStats := fetchServerStats(*host, *httpPort, false); errStats == nil {
+					reportSweepPoint(*environment, time.Since(pointStart), stats.cpuTime()-pointStats.cpuTime())
+				}
+				return nil
+			})
 		}
 	}
 
+	progress.finish()
 }
 
 func getFirstByte(protocol string, environment string, write func(data []byte) (n int, err error), read func(buf []byte) (n int, err error)) error {
@@ -220,57 +686,52 @@ func flood(protocol string, environment string, size int, write func(data []byte
 
 	// start := time.Now()
 
-	finishedSend := make(chan bool)
-	finishedRecv := make(chan bool)
+	sampler := startSampler(protocol, environment, measureAcknowledged, size)
 
 	totalSent := 0
-	go func(finished chan bool) {
+	finishedSend := goWorker(func() error {
 		left := size
 		for left > 0 {
-			current := min(left, bufferMaxSize)
+			current := min(left, writeChunkSize)
 
 			_, err := write(dataBuffer[totalSent : totalSent+current])
 			if err != nil {
-				fmt.Println(err)
-				finished <- false
-				break
-			} else {
-				totalSent += current
-				left -= current
+				return err
 			}
+			totalSent += current
+			left -= current
 		}
+		return nil
+	})
 
-		finished <- true
-	}(finishedSend)
-
-	// var duration time.Duration
-	go func(finished chan bool) {
+	finishedRecv := goWorker(func() error {
 		received := 0
 		for received < size {
 			buf := make([]byte, 8)
 			_, err := read(buf)
 			if err != nil {
-				fmt.Println(err)
-				finished <- false
-				break
+				return err
 			}
 
 			sizeString := string(bytes.Trim(buf, "\x00"))
 			sizeRecv, _ := strconv.Atoi(sizeString)
 			received += int(sizeRecv)
+			sampler.add(sizeRecv)
 		}
-		finished <- true
-
-	}(finishedRecv)
-
-	sendOk := <-finishedSend
-	recvOk := <-finishedRecv
+		return nil
+	})
 
-	// Code to measure
-	// duration := time.Since(start)
+	errSend := <-finishedSend
+	if errSend != nil {
+		fmt.Println(errSend)
+	}
+	errRecv := <-finishedRecv
+	if errRecv != nil {
+		fmt.Println(errRecv)
+	}
+	sampler.finish(errSend == nil && errRecv == nil)
 
-	if sendOk && recvOk {
-		// report(protocol, environment, "Raw", setupDuration, size, duration)
+	if errSend == nil && errRecv == nil {
 		return nil
 	} else {
 		return fmt.Errorf("%s: %d did not finish ", protocol, size)
@@ -301,7 +762,7 @@ func clientQuicMain(environment string, host string, quicPort int) error {
 			return err1
 		}
 
-		session, err := quic.DialAddr(url, tlsConf, nil)
+		session, err := quicImplementation.dial(url, tlsConf, quicTuning.options(quicOptions{}))
 		if err != nil {
 			return err
 		}
@@ -364,7 +825,7 @@ func clientTcpMain(environment string, host string, tcpPort int) error {
 
 		start := time.Now()
 
-		session, err := net.Dial("tcp", url)
+		session, err := tcpTuning.dial("tcp", url)
 		if err != nil {
 			return err
 		}
@@ -424,7 +885,7 @@ func clientTcpTlsMain(environment string, host string, tcpPort int) error {
 
 		start := time.Now()
 
-		session, err := tls.Dial("tcp", url, tlsConf)
+		session, err := tcpTuning.dialTls("tcp", url, tlsConf)
 		if err != nil {
 			return err
 		}
@@ -484,13 +945,25 @@ func floodHttp(protocol string, environment string, size int, sizeIndex int, cli
 	reader := bytes.NewReader(httpByteBuffer[sizeIndex])
 	// fmt.Printf("[%s - %s] Sending %d bytes (size index: %d)\n", protocol, environment, len(httpByteBuffer[sizeIndex]), sizeIndex)
 
+	request, err := http.NewRequest(http.MethodPost, url, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	sampler := startSampler(protocol, environment, measureSent, size)
+	if sampler != nil {
+		request.Body = &sampledBody{ReadCloser: request.Body, sampler: sampler}
+	}
+
 	// start := time.Now()
-	response, err := client.Post(url, "application/octet-stream", reader)
+	response, err := client.Do(request)
 	if err != nil {
+		sampler.finish(false)
 		return err
 	}
 
 	_, errDump := ioutil.ReadAll(response.Body)
+	sampler.finish(errDump == nil)
 	if errDump != nil {
 		return err
 	}
@@ -505,12 +978,29 @@ func floodHttp(protocol string, environment string, size int, sizeIndex int, cli
 	return nil
 }
 
-func clientHttpMain(environment string, host string, httpsPort int) error {
+// A transport that stays on HTTP/1.1 over TLS
+func newHttp1TlsTransport() *http.Transport {
+	customTransport := newHttpTransport()
+	customTransport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	}
+	customTransport.ForceAttemptHTTP2 = false
+	customTransport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{} // non-nil, so HTTP/2 stays off
+	return customTransport
+}
+
+func clientHttpMain(environment string, host string, httpsPort int, useTls bool) error {
 	fmt.Println("Testing HTTP...")
 	protocolName := "HTTP/1" // for report and logging strings
 	url := fmt.Sprintf("http://%s:%d/", host, httpsPort)
 
-	customTransport := &(*http.DefaultTransport.(*http.Transport)) // make shallow copy
+	customTransport := newHttpTransport()
+	if useTls {
+		protocolName += " (TLS)"
+		url = fmt.Sprintf("https://%s:%d/", host, httpsPort)
+		customTransport = newHttp1TlsTransport()
+	}
 
 	size := initialMessageSize
 	sizeIndex := 0
@@ -577,7 +1067,42 @@ func clientHttpsMain(environment string, host string, httpsPort int, multiplex b
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"h2"},
 	}
-	customTransport := &http2.Transport{TLSClientConfig: tlsConf, StrictMaxConcurrentStreams: true, AllowHTTP: false}
+	customTransport := &http2.Transport{TLSClientConfig: tlsConf, StrictMaxConcurrentStreams: true, AllowHTTP: false, DialTLS: tcpTuning.dialTlsConn}
+
+	return clientHttp2Main(environment, protocolName, url, customTransport, multiplex, multiFilesToSend)
+}
+
+// Cleartext HTTP/2 against the HTTP port, either with prior knowledge or upgraded from HTTP/1.1
+func clientH2cMain(environment string, host string, httpPort int, upgrade bool, multiplex bool, multiFilesToSend int) error {
+
+	fmt.Println("Testing h2c...")
+	protocolName := "HTTP/2 (h2c)" // for report and logging strings
+	if upgrade {
+		protocolName = "HTTP/2 (h2c Upgrade)"
+	}
+	if multiplex {
+		protocolName += " (Multiplex)"
+	}
+
+	url := fmt.Sprintf("http://%s:%d/", host, httpPort)
+	var customTransport http.RoundTripper
+	if upgrade {
+		customTransport = newH2cUpgradeTransport(host, httpPort)
+	} else {
+		customTransport = &http2.Transport{
+			StrictMaxConcurrentStreams: true,
+			AllowHTTP:                  true,
+			DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return tcpTuning.dial(network, addr)
+			},
+		}
+	}
+
+	return clientHttp2Main(environment, protocolName, url, customTransport, multiplex, multiFilesToSend)
+}
+
+// Flood url with every message size over one HTTP/2 transport, TLS or not
+func clientHttp2Main(environment string, protocolName string, url string, customTransport http.RoundTripper, multiplex bool, multiFilesToSend int) error {
 
 	size := initialMessageSize
 	sizeIndex := 0
@@ -603,24 +1128,22 @@ func clientHttpsMain(environment string, host string, httpsPort int, multiplex b
 		firstByteDuration := time.Since(start)
 		floodStart := time.Now()
 
-		var wg sync.WaitGroup
+		var workers []<-chan error
 
 		var err error
 		for fileNum := 0; fileNum < multiFilesToSend; fileNum++ {
 			if multiplex {
-				wg.Add(1)
-
-				go func(wg *sync.WaitGroup) {
-					err = floodHttp(protocolName, environment, size, sizeIndex, client, url)
-					wg.Done()
-
-				}(&wg)
+				workers = append(workers, goWorker(func() error {
+					return floodHttp(protocolName, environment, size, sizeIndex, client, url)
+				}))
 			} else {
 				err = floodHttp(protocolName, environment, size, sizeIndex, client, url)
 			}
 		}
 
-		wg.Wait()
+		if errWorkers := waitWorkers(workers); errWorkers != nil {
+			err = errWorkers
+		}
 
 		duration := time.Since(floodStart)
 		if err != nil {
@@ -660,8 +1183,8 @@ func clientHttp3Main(environment string, host string, http3Port int, multiplex b
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"h3"},
 	}
-	quicConfig := &quic.Config{KeepAlive: true}
-	quicTransport := &http3.RoundTripper{TLSClientConfig: tlsConf, QuicConfig: quicConfig}
+	quicConfig := quicTuning.options(quicOptions{keepAlive: true})
+	quicTransport := quicImplementation.http3Transport(tlsConf, quicConfig)
 
 	size := initialMessageSize
 	sizeIndex := 0
@@ -687,24 +1210,22 @@ func clientHttp3Main(environment string, host string, http3Port int, multiplex b
 		firstByteDuration := time.Since(start)
 		floodStart := time.Now()
 
-		var wg sync.WaitGroup
+		var workers []<-chan error
 
 		var err error
 		for fileNum := 0; fileNum < multiFilesToSend; fileNum++ {
 			if multiplex {
-				wg.Add(1)
-
-				go func(wg *sync.WaitGroup) {
-					err = floodHttp(protocolName, environment, size, sizeIndex, client, url)
-					wg.Done()
-
-				}(&wg)
+				workers = append(workers, goWorker(func() error {
+					return floodHttp(protocolName, environment, size, sizeIndex, client, url)
+				}))
 			} else {
 				err = floodHttp(protocolName, environment, size, sizeIndex, client, url)
 			}
 		}
 
-		wg.Wait()
+		if errWorkers := waitWorkers(workers); errWorkers != nil {
+			err = errWorkers
+		}
 
 		duration := time.Since(floodStart)
 		if err != nil {
@@ -741,3 +1262,13 @@ func min(a int, b int) int {
 
 	return b
 }
+
+func pad(bb []byte, size int) []byte {
+	l := len(bb)
+	if l == size {
+		return bb
+	}
+	tmp := make([]byte, size)
+	copy(tmp[size-l:], bb)
+	return tmp
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A multi-node experiment, run by -controller on agents started with -agent
+// (see agent.go): the servers start first, then all the clients at the same
+// instant, and the servers stop once every client is done. The reports, logs
+// and host details of every agent end up in one directory of the controller.
+type scenario struct {
+	Name       string          `json:"name"`
+	StartDelay float64         `json:"startDelay,omitempty"` // seconds between the servers being up and the clients starting
+	Agents     []scenarioAgent `json:"agents"`
+}
+
+type scenarioAgent struct {
+	Name    string   `json:"name"`            // directory of its results
+	Address string   `json:"address"`         // host:port of the agent's -agent
+	Role    string   `json:"role"`            // client or server
+	Args    []string `json:"args,omitempty"`  // flags of the client or server
+	Files   []string `json:"files,omitempty"` // pushed next to the run, paths relative to the scenario
+	Ready   string   `json:"ready,omitempty"` // host:port the server accepts on once up, as the agent sees it
+}
+
+func loadScenario(fileName string) (*scenario, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{StartDelay: 2}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+	if len(s.Agents) == 0 {
+		return nil, fmt.Errorf("%s: no agents", fileName)
+	}
+	names := make(map[string]bool)
+	for _, agent := range s.Agents {
+		if agent.Name == "" || filepath.Base(agent.Name) != agent.Name || names[agent.Name] {
+			return nil, fmt.Errorf("%s: agent names must be unique plain names, got %q", fileName, agent.Name)
+		}
+		names[agent.Name] = true
+		if agent.Role != agentRoleClient && agent.Role != agentRoleServer {
+			return nil, fmt.Errorf("%s: agent %s has unknown role %q", fileName, agent.Name, agent.Role)
+		}
+	}
+	return s, nil
+}
+
+// The controller's side of an agent.
+type agentSession struct {
+	config  scenarioAgent
+	control *controlConn
+	offset  time.Duration // agent's clock minus the controller's
+	host    *hostInfo
+	done    *agentMessage
+}
+
+// Connect, push the files and estimate the agent's clock offset from the round trip.
+func prepareAgent(config scenarioAgent, scenarioDir string, token string) (*agentSession, error) {
+	files := make(map[string][]byte)
+	for _, path := range config.Files {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(scenarioDir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(path)] = content
+	}
+
+	conn, err := net.DialTimeout("tcp", config.Address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	session := &agentSession{config: config, control: newControlConn(conn)}
+
+	sent := time.Now()
+	err = session.control.send(&agentMessage{Type: agentPrepare, Token: token, Role: config.Role, Args: config.Args, Files: files, Ready: config.Ready})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ready, err := session.control.receive(agentReady)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	received := time.Now()
+	session.offset = ready.Clock.Sub(sent.Add(received.Sub(sent) / 2))
+	session.host = ready.Host
+	fmt.Printf("[%s] %s at %s, clock offset %s\n", config.Name, config.Role, config.Address, session.offset)
+	return session, nil
+}
+
+// Start the agent at the controller's time at, and wait for it to be running.
+func (s *agentSession) start(at time.Time) error {
+	if err := s.control.send(&agentMessage{Type: agentStart, At: at.Add(s.offset)}); err != nil {
+		return err
+	}
+	_, err := s.control.receive(agentStarted)
+	return err
+}
+
+func (s *agentSession) wait() error {
+	done, err := s.control.receive(agentDone)
+	if err != nil {
+		return err
+	}
+	s.done = done
+	fmt.Printf("[%s] done, exit code %d, %d files\n", s.config.Name, done.ExitCode, len(done.Files))
+	return nil
+}
+
+// Write the output and log of the agent under dir.
+func (s *agentSession) save(dir string) error {
+	agentDir := filepath.Join(dir, s.config.Name)
+	if err := os.MkdirAll(agentDir, 0777); err != nil {
+		return err
+	}
+	if s.done == nil {
+		return nil
+	}
+	for name, content := range s.done.Files {
+		if err := ioutil.WriteFile(filepath.Join(agentDir, filepath.Base(name)), content, 0666); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(agentDir, s.config.Role+".log"), []byte(s.done.Log), 0666)
+}
+
+// Run every agent of a scenario at once, for each of the sessions given, failing on the first error.
+func eachAgent(sessions []*agentSession, run func(session *agentSession) error) error {
+	errs := make(chan error, len(sessions))
+	for _, session := range sessions {
+		go func(session *agentSession) {
+			if err := run(session); err != nil {
+				errs <- fmt.Errorf("agent %s: %s", session.config.Name, err)
+				return
+			}
+			errs <- nil
+		}(session)
+	}
+	var first error
+	for range sessions {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Run the scenario on agents started with token, writing the results under outputRoot/<name>-<time>.
+func controllerMain(scenarioFile string, outputRoot string, token string) error {
+	s, err := loadScenario(scenarioFile)
+	if err != nil {
+		return err
+	}
+	runDir := filepath.Join(outputRoot, fmt.Sprintf("%s-%s", s.Name, time.Now().Format("20060102-150405")))
+
+	// Prepared in the order of the scenario, at once.
+	sessions := make([]*agentSession, len(s.Agents))
+	defer func() {
+		for _, session := range sessions {
+			if session != nil {
+				session.control.conn.Close()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.Agents))
+	for i, config := range s.Agents {
+		wg.Add(1)
+		go func(i int, config scenarioAgent) {
+			defer wg.Done()
+			session, err := prepareAgent(config, filepath.Dir(scenarioFile), token)
+			if err != nil {
+				errs <- fmt.Errorf("agent %s: %s", config.Name, err)
+				return
+			}
+			sessions[i] = session
+		}(i, config)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	var servers, clients []*agentSession
+	for _, session := range sessions {
+		if session.config.Role == agentRoleServer {
+			servers = append(servers, session)
+		} else {
+			clients = append(clients, session)
+		}
+	}
+
+	if err := eachAgent(servers, func(session *agentSession) error { return session.start(time.Now()) }); err != nil {
+		return err
+	}
+	at := time.Now().Add(time.Duration(s.StartDelay * float64(time.Second)))
+	fmt.Printf("Starting %d clients at %s\n", len(clients), at.Format(time.RFC3339Nano))
+	errRun := eachAgent(clients, func(session *agentSession) error {
+		if err := session.start(at); err != nil {
+			return err
+		}
+		return session.wait()
+	})
+
+	// Servers go on until stopped, whether the clients succeeded or not.
+	errStop := eachAgent(servers, func(session *agentSession) error {
+		if err := session.control.send(&agentMessage{Type: agentStop}); err != nil {
+			return err
+		}
+		return session.wait()
+	})
+
+	hosts := make(map[string]*hostInfo)
+	for _, session := range sessions {
+		hosts[session.config.Name] = session.host
+		if err := session.save(runDir); err != nil {
+			return err
+		}
+	}
+	hostsJson, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(runDir, "hosts.json"), hostsJson, 0666); err != nil {
+		return err
+	}
+	scenarioJson, err := ioutil.ReadFile(scenarioFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(runDir, "scenario.json"), scenarioJson, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("Results of %s in %s\n", s.Name, runDir)
+
+	if errRun != nil {
+		return errRun
+	}
+	return errStop
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fan-in runs K virtual clients against the server at once, each flooding it
+// over a connection of its own like the raw tests, to see how flows share the
+// bottleneck. Clients connect first, then all flood from the same instant for
+// the configured duration. Each one's goodput is what the server acknowledged
+// before the end, and Jain's index over them says how fairly it was shared:
+// 1 when every client got the same, 1/K when one got everything.
+//
+// With a bottleneck (see bottleneck.go) the flows compete for its rate rather
+// than for the path, which with a long QUIC and a long TCP flow says whether
+// quic-go's congestion control is TCP-friendly. Sampling what was acknowledged
+// every interval shows how the shares evolve, and the index over the second
+// half of the run leaves slow start out.
+const (
+	fanInQuic   = "quic"
+	fanInTcp    = "tcp"
+	fanInTcpTls = "tcpTls"
+
+	fanInSetupTime = 2 * time.Second // for every client to connect, or start, before flooding
+
+	fanInResultPrefix = "fanInResult " // line of a worker process's result on its stdout
+)
+
+// How many clients flood over a protocol.
+type fanInGroup struct {
+	protocol string
+	clients  int
+}
+
+type fanInConfig struct {
+	groups    []fanInGroup
+	duration  time.Duration
+	processes bool // a client process each instead of goroutines
+
+	bottleneck *bottleneckSettings // nil for none
+	sample     time.Duration       // between samples of what was acknowledged, 0 for none
+}
+
+// What one virtual client is told to do, passed as JSON to a worker process.
+type fanInJob struct {
+	Protocol string    `json:"protocol"`
+	Addr     string    `json:"addr"`
+	Start    time.Time `json:"start"`
+	Duration int64     `json:"durationMs"`
+	Point    int       `json:"point"` // index of the sweep point, for the QUIC settings and chunk size
+	Sample   int64     `json:"sampleMs,omitempty"`
+}
+
+type fanInResult struct {
+	Protocol string `json:"protocol"`
+	Bytes    int    `json:"bytes"`             // acknowledged before the end
+	Samples  []int  `json:"samples,omitempty"` // acknowledged in every sample interval
+	Error    string `json:"error,omitempty"`
+}
+
+func fanInProtocolName(protocol string) string {
+	switch protocol {
+	case fanInQuic:
+		return "QUIC"
+	case fanInTcp:
+		return "TCP"
+	}
+	return "TCP_TLS"
+}
+
+// Parse clients per protocol, like quic:4,tcp:4.
+func parseFanIn(spec string, duration time.Duration, processes bool, bottleneck *bottleneckSettings, sample time.Duration) (*fanInConfig, error) {
+	config := &fanInConfig{duration: duration, processes: processes, bottleneck: bottleneck, sample: sample}
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		if len(parts) != 2 || (parts[0] != fanInQuic && parts[0] != fanInTcp && parts[0] != fanInTcpTls) {
+			return nil, fmt.Errorf("invalid fan-in %q, expected <quic|tcp|tcpTls>:<clients>", field)
+		}
+		clients, err := strconv.Atoi(parts[1])
+		if err != nil || clients <= 0 {
+			return nil, fmt.Errorf("invalid fan-in client count %q", field)
+		}
+		config.groups = append(config.groups, fanInGroup{protocol: parts[0], clients: clients})
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("fan-in duration must be positive")
+	}
+	if sample < 0 || sample > duration {
+		return nil, fmt.Errorf("fan-in sample interval must be between 0 and the duration")
+	}
+	return config, nil
+}
+
+func (c *fanInConfig) String() string {
+	var labels []string
+	for _, group := range c.groups {
+		labels = append(labels, fmt.Sprintf("%s:%d", group.protocol, group.clients))
+	}
+	return strings.Join(labels, " ")
+}
+
+// Connect over protocol, returning the stream to flood and how to tear everything down.
+func dialFanIn(protocol string, addr string) (io.ReadWriter, func(), error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+	switch protocol {
+	case fanInQuic:
+		session, err := quicImplementation.dial(addr, tlsConf, quicTuning.options(quicOptions{}))
+		if err != nil {
+			return nil, nil, err
+		}
+		stream, err := session.OpenStreamSync(context.Background())
+		if err != nil {
+			session.CloseWithError(0, "")
+			return nil, nil, err
+		}
+		return stream, func() { session.CloseWithError(0, "") }, nil
+	case fanInTcp:
+		conn, err := tcpTuning.dial("tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() { conn.Close() }, nil
+	}
+	conn, err := tcpTuning.dialTls("tcp", addr, tlsConf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { conn.Close() }, nil
+}
+
+// One virtual client: connect, wait for the start, then flood until the end of the job.
+func runFanInJob(job *fanInJob) *fanInResult {
+	result := &fanInResult{Protocol: job.Protocol}
+	stream, closeStream, err := dialFanIn(job.Protocol, job.Addr)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if time.Now().After(job.Start) {
+		closeStream()
+		result.Error = "connected after the start"
+		return result
+	}
+	time.Sleep(time.Until(job.Start))
+
+	// Closing the connection at the end unblocks the writes and the reads.
+	end := job.Start.Add(time.Duration(job.Duration) * time.Millisecond)
+	timer := time.AfterFunc(time.Until(end), closeStream)
+	defer timer.Stop()
+	defer closeStream()
+
+	// Writes fail once the connection is closed at the end, only a panic is an error.
+	writer := goWorker(func() error {
+		for time.Now().Before(end) {
+			if _, err := stream.Write(dataBuffer[:writeChunkSize]); err != nil {
+				return nil
+			}
+		}
+		return nil
+	})
+
+	// The server acknowledges every read with its size, in 8 bytes.
+	sample := time.Duration(job.Sample) * time.Millisecond
+	if sample > 0 {
+		result.Samples = make([]int, (time.Duration(job.Duration)*time.Millisecond+sample-1)/sample)
+	}
+	ack := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(stream, ack); err != nil {
+			break
+		}
+		now := time.Now()
+		if now.After(end) {
+			break
+		}
+		acknowledged, _ := strconv.Atoi(string(bytes.Trim(ack, "\x00")))
+		result.Bytes += acknowledged
+		if sample > 0 {
+			if interval := int(now.Sub(job.Start) / sample); interval < len(result.Samples) {
+				result.Samples[interval] += acknowledged
+			}
+		}
+	}
+	closeStream()
+	if err := <-writer; err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Run a job in a worker process, a copy of this client with the same flags.
+func runFanInWorker(job *fanInJob) *fanInResult {
+	result := &fanInResult{Protocol: job.Protocol}
+	jobJson, _ := json.Marshal(job)
+	binary, err := os.Executable()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	worker := exec.Command(binary, append(append([]string{}, os.Args[1:]...), "-fanInWorker", string(jobJson))...)
+	worker.Stderr = os.Stderr
+	output, err := worker.Output()
+	if err != nil {
+		result.Error = fmt.Sprintf("worker: %s", err)
+		return result
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, fanInResultPrefix) {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, fanInResultPrefix)), result); err != nil {
+				result.Error = err.Error()
+			}
+			return result
+		}
+	}
+	result.Error = "worker printed no result"
+	return result
+}
+
+// How a worker process hands its result back.
+func printFanInResult(result *fanInResult) {
+	resultJson, _ := json.Marshal(result)
+	fmt.Printf("%s%s\n", fanInResultPrefix, resultJson)
+}
+
+// Jain's fairness index of the rates: (sum x)^2 / (n * sum x^2).
+func jainIndex(rates []float64) float64 {
+	sum, squares := 0.0, 0.0
+	for _, rate := range rates {
+		sum += rate
+		squares += rate * rate
+	}
+	if squares == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(rates)) * squares)
+}
+
+// Append the goodput of every client of a fan-in run to the fan-in file of the environment.
+func reportFanIn(environment string, config *fanInConfig, results []*fanInResult) {
+	var rates []float64
+	protocolRates := make(map[string][]float64)
+	for _, result := range results {
+		rate := float64(result.Bytes) * 8 / 1000 / config.duration.Seconds()
+		rates = append(rates, rate)
+		protocolRates[result.Protocol] = append(protocolRates[result.Protocol], rate)
+	}
+	fairness := jainIndex(rates)
+	total := 0.0
+	for _, rate := range rates {
+		total += rate
+	}
+	steadyFairness := jainIndex(steadyRates(config, results))
+	fmt.Printf("[Fan-in - %s] %s, %d clients, goodput: %.0f kbps, Jain's index: %.3f (second half: %.3f)\n", environment, config, len(results), total, fairness, steadyFairness)
+	var protocols []string
+	for protocol := range protocolRates {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		share := 0.0
+		for _, rate := range protocolRates[protocol] {
+			share += rate
+		}
+		fmt.Printf("[Fan-in - %s] %s: %d clients, %.0f kbps (%.1f%%), Jain's index: %.3f\n", environment, fanInProtocolName(protocol), len(protocolRates[protocol]), share, 100*share/total, jainIndex(protocolRates[protocol]))
+	}
+
+	fileName := outputFile("fanin", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	for i, result := range results {
+		f.WriteString(fmt.Sprintf("%s,%s,%s,%t,%s,%d,", fanInProtocolName(result.Protocol), environment, config, config.processes, config.bottleneck, i))
+		f.WriteString(fmt.Sprintf("%d,%d,%f,%f,%f,%f", config.duration.Milliseconds(), result.Bytes, rates[i], fairness, jainIndex(protocolRates[result.Protocol]), steadyFairness))
+		f.WriteString(settingsColumns())
+		f.WriteString("\n")
+	}
+
+	if config.sample > 0 {
+		reportFanInSeries(environment, config, results)
+	}
+}
+
+// The rate of every client over the second half of the run, from its samples, none if not sampled.
+func steadyRates(config *fanInConfig, results []*fanInResult) []float64 {
+	if config.sample <= 0 {
+		return nil
+	}
+	var rates []float64
+	for _, result := range results {
+		half := result.Samples[len(result.Samples)/2:]
+		acknowledged := 0
+		for _, bytes := range half {
+			acknowledged += bytes
+		}
+		rates = append(rates, float64(acknowledged)*8/1000/(time.Duration(len(half))*config.sample).Seconds())
+	}
+	return rates
+}
+
+// Append what every client got in every sample interval to the fan-in series file of the environment.
+func reportFanInSeries(environment string, config *fanInConfig, results []*fanInResult) {
+	fileName := outputFile("fanin_series", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	for i, result := range results {
+		for sample, acknowledged := range result.Samples {
+			end := time.Duration(sample+1) * config.sample
+			f.WriteString(fmt.Sprintf("%s,%s,%s,%s,%d,", fanInProtocolName(result.Protocol), environment, config, config.bottleneck, i))
+			f.WriteString(fmt.Sprintf("%d,%d,%f", end.Milliseconds(), acknowledged, float64(acknowledged)*8/1000/config.sample.Seconds()))
+			f.WriteString(settingsColumns())
+			f.WriteString("\n")
+		}
+	}
+}
+
+// Run every client of the config at once, ports giving where each protocol floods. point is the sweep point of the run.
+func clientFanInMain(environment string, host string, ports map[string]int, config *fanInConfig, point int) error {
+	fmt.Printf("Testing fan-in of %s (bottleneck: %s)...\n", config, config.bottleneck)
+	var bottleneckPorts []int
+	for _, group := range config.groups {
+		if ports[group.protocol] <= 0 {
+			return fmt.Errorf("fan-in over %s needs its port", group.protocol)
+		}
+		bottleneckPorts = append(bottleneckPorts, ports[group.protocol])
+	}
+	if config.bottleneck != nil {
+		remove, err := config.bottleneck.install(host, bottleneckPorts)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	start := time.Now().Add(fanInSetupTime)
+
+	var jobs []*fanInJob
+	for _, group := range config.groups {
+		for i := 0; i < group.clients; i++ {
+			jobs = append(jobs, &fanInJob{
+				Protocol: group.protocol,
+				Addr:     fmt.Sprintf("%s:%d", host, ports[group.protocol]),
+				Start:    start,
+				Duration: config.duration.Milliseconds(),
+				Point:    point,
+				Sample:   config.sample.Milliseconds(),
+			})
+		}
+	}
+
+	results := make([]*fanInResult, len(jobs))
+	workers := make([]<-chan error, len(jobs))
+	for i, job := range jobs {
+		i, job := i, job
+		workers[i] = goWorker(func() error {
+			if config.processes {
+				results[i] = runFanInWorker(job)
+			} else {
+				results[i] = runFanInJob(job)
+			}
+			return nil
+		})
+	}
+	for i, worker := range workers {
+		if err := <-worker; err != nil {
+			results[i] = &fanInResult{Protocol: jobs[i].Protocol, Error: err.Error()}
+		}
+	}
+
+	for i, result := range results {
+		if result.Error != "" {
+			return fmt.Errorf("fan-in client %d (%s): %s", i, fanInProtocolName(result.Protocol), result.Error)
+		}
+	}
+	reportFanIn(environment, config, results)
+	return nil
+}
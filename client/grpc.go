@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const grpcServiceName = "benchmark.Echo"
+const grpcMaxMessageSize = finalMessageSize + 1024
+
+// The gRPC call types exercised by the client, one report row each.
+var grpcCallTypes = []string{"Unary", "ClientStream", "ServerStream", "Bidi"}
+
+// grpcBytesCodec passes raw byte slices through, see server/grpc.go.
+type grpcBytesCodec struct{}
+
+func (grpcBytesCodec) Marshal(v interface{}) ([]byte, error) {
+	switch message := v.(type) {
+	case []byte:
+		return message, nil
+	case *[]byte:
+		return *message, nil
+	}
+	return nil, fmt.Errorf("grpcBytesCodec: cannot marshal %T", v)
+}
+
+func (grpcBytesCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpcBytesCodec: cannot unmarshal into %T", v)
+	}
+	*message = data
+	return nil
+}
+
+func (grpcBytesCodec) Name() string {
+	return "bytes"
+}
+
+type grpcClientStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+	CloseSend() error
+}
+
+// grpcTransport opens calls to the echo service, over grpc-go's HTTP/2 transport or our own HTTP/3 one.
+type grpcTransport interface {
+	NewStream(ctx context.Context, method string) (grpcClientStream, error)
+	Close() error
+}
+
+type grpcHttp2Transport struct {
+	conn *grpc.ClientConn
+}
+
+func dialGrpcHttp2(host string, port int) (grpcTransport, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	conn, err := grpc.DialContext(context.Background(), fmt.Sprintf("%s:%d", host, port),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return tcpTuning.dialContext(ctx, "tcp", addr)
+		}),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(grpcBytesCodec{}),
+			grpc.MaxCallRecvMsgSize(grpcMaxMessageSize),
+			grpc.MaxCallSendMsgSize(grpcMaxMessageSize),
+		),
+		grpc.WithBlock(), // so the handshake counts as setup time
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcHttp2Transport{conn: conn}, nil
+}
+
+func (t *grpcHttp2Transport) NewStream(ctx context.Context, method string) (grpcClientStream, error) {
+	desc := &grpc.StreamDesc{StreamName: method, ClientStreams: true, ServerStreams: true}
+	return t.conn.NewStream(ctx, desc, fmt.Sprintf("/%s/%s", grpcServiceName, method))
+}
+
+func (t *grpcHttp2Transport) Close() error {
+	return t.conn.Close()
+}
+
+// What the samples of a call of each type count, see series.go.
+var grpcSampleMeasures = map[string]string{
+	"Unary":        measureSent,
+	"ClientStream": measureSent,
+	"ServerStream": measureReceived,
+	"Bidi":         measureAcknowledged,
+}
+
+// Run a single call of callType moving size bytes, and check the server saw all of them.
+// The sampler, if any, counts the bytes moved as grpcSampleMeasures says.
+func grpcCall(transport grpcTransport, callType string, size int, sampler *transferSampler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := transport.NewStream(ctx, callType)
+	if err != nil {
+		return err
+	}
+
+	received := 0
+	switch callType {
+	case "Unary":
+		if err := stream.SendMsg(dataBuffer[:size]); err != nil {
+			return err
+		}
+		sampler.add(size)
+		stream.CloseSend()
+
+		var ack []byte
+		if err := stream.RecvMsg(&ack); err != nil {
+			return err
+		}
+		received = parseAck(ack)
+	case "ClientStream":
+		for sent := 0; sent < size; {
+			current := min(size-sent, writeChunkSize)
+			if err := stream.SendMsg(dataBuffer[sent : sent+current]); err != nil {
+				return err
+			}
+			sampler.add(current)
+			sent += current
+		}
+		stream.CloseSend()
+
+		var ack []byte
+		if err := stream.RecvMsg(&ack); err != nil {
+			return err
+		}
+		received = parseAck(ack)
+	case "ServerStream":
+		if err := stream.SendMsg(pad([]byte(fmt.Sprintf("%d", size)), 8)); err != nil {
+			return err
+		}
+		stream.CloseSend()
+
+		for received < size {
+			var message []byte
+			if err := stream.RecvMsg(&message); err != nil {
+				return err
+			}
+			received += len(message)
+			sampler.add(len(message))
+		}
+	case "Bidi":
+		sendErr := goWorker(func() error {
+			for sent := 0; sent < size; {
+				current := min(size-sent, writeChunkSize)
+				if err := stream.SendMsg(dataBuffer[sent : sent+current]); err != nil {
+					return err
+				}
+				sent += current
+			}
+			return stream.CloseSend()
+		})
+
+		for received < size {
+			var ack []byte
+			if err := stream.RecvMsg(&ack); err != nil {
+				return err
+			}
+			ackSize := parseAck(ack)
+			received += ackSize
+			sampler.add(ackSize)
+		}
+		if err := <-sendErr; err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown gRPC call type %q", callType)
+	}
+
+	// Drain the stream so the call ends with the server's status.
+	var extra []byte
+	if err := stream.RecvMsg(&extra); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("gRPC %s: unexpected message after the response", callType)
+		}
+		return err
+	}
+
+	if received != size {
+		return fmt.Errorf("gRPC %s: %d did not finish, server saw %d", callType, size, received)
+	}
+	return nil
+}
+
+func clientGrpcMain(environment string, host string, grpcPort int, useHttp3 bool, callType string) error {
+	transportName := "HTTP/2"
+	if useHttp3 {
+		transportName = "HTTP/3"
+	}
+	fmt.Printf("Testing gRPC %s (%s)...\n", callType, transportName)
+	protocolName := fmt.Sprintf("gRPC %s (%s)", callType, transportName) // for report and logging strings
+
+	size := initialMessageSize
+	for size <= finalMessageSize {
+		memoryBefore, err2 := memory.Get()
+		if err2 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err2)
+			return err2
+		}
+
+		cpuBefore, err1 := cpu.Get()
+		if err1 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err1)
+			return err1
+		}
+
+		start := time.Now()
+
+		var transport grpcTransport
+		var err error
+		if useHttp3 {
+			transport, err = dialGrpcHttp3(host, grpcPort)
+		} else {
+			transport, err = dialGrpcHttp2(host, grpcPort)
+		}
+		if err != nil {
+			return err
+		}
+		setupDuration := time.Since(start)
+		grpcCall(transport, "Unary", 1, nil)
+		firstByteDuration := time.Since(start)
+
+		latencies := make([]time.Duration, 0, filesToSend)
+		floodStart := time.Now()
+		for fileNum := 0; fileNum < filesToSend; fileNum++ {
+			callStart := time.Now()
+			sampler := startSampler(protocolName, environment, grpcSampleMeasures[callType], size)
+			err = grpcCall(transport, callType, size, sampler)
+			sampler.finish(err == nil)
+			if err != nil {
+				break
+			}
+			latencies = append(latencies, time.Since(callStart))
+		}
+		duration := time.Since(floodStart)
+		transport.Close()
+
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			cpuAfter, err1 := cpu.Get()
+			if err1 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err1)
+				return err1
+			}
+			memoryAfter, err2 := memory.Get()
+			if err2 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err2)
+				return err2
+			}
+			report(protocolName, environment, "gRPC", filesToSend, setupDuration, firstByteDuration, size, duration, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+			reportLatencies(protocolName, environment, "gRPC", size, latencies, duration)
+		}
+
+		size *= 2
+	}
+	return nil
+}
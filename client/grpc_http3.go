@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpc-go can't run over QUIC, so calls over HTTP/3 are plain streaming POSTs
+// carrying length-prefixed gRPC messages. quic-go v0.25 drops response trailers,
+// so only a Trailers-Only status (sent as headers) can be seen by the client,
+// and a clean end of the response body is taken as OK.
+type grpcHttp3Transport struct {
+	url          string
+	roundTripper http.RoundTripper
+}
+
+type grpcHttp3ClientStream struct {
+	requestBody *io.PipeWriter
+	responses   chan *http.Response
+	errors      chan error
+	body        io.ReadCloser
+}
+
+func dialGrpcHttp3(host string, port int) (grpcTransport, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+	quicConfig := quicTuning.options(quicOptions{keepAlive: true})
+	roundTripper := quicImplementation.http3Transport(tlsConf, quicConfig)
+
+	return &grpcHttp3Transport{url: fmt.Sprintf("https://%s:%d", host, port), roundTripper: roundTripper}, nil
+}
+
+func (t *grpcHttp3Transport) NewStream(ctx context.Context, method string) (grpcClientStream, error) {
+	reader, writer := io.Pipe()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/%s", t.url, grpcServiceName, method), reader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("Accept-Encoding", "identity") // gRPC compresses messages itself, if at all
+
+	stream := &grpcHttp3ClientStream{
+		requestBody: writer,
+		responses:   make(chan *http.Response, 1),
+		errors:      make(chan error, 1),
+	}
+
+	// The response headers arrive while the request body is still being sent.
+	go func() {
+		response, err := t.roundTripper.RoundTrip(request)
+		if err != nil {
+			reader.CloseWithError(err)
+			stream.errors <- err
+			return
+		}
+		stream.responses <- response
+	}()
+
+	return stream, nil
+}
+
+func (t *grpcHttp3Transport) Close() error {
+	if closer, ok := t.roundTripper.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *grpcHttp3ClientStream) SendMsg(m interface{}) error {
+	message, err := grpcBytesCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	if _, err := s.requestBody.Write(prefix); err != nil {
+		return err
+	}
+	_, err = s.requestBody.Write(message)
+	return err
+}
+
+func (s *grpcHttp3ClientStream) CloseSend() error {
+	return s.requestBody.Close()
+}
+
+func (s *grpcHttp3ClientStream) RecvMsg(m interface{}) error {
+	message, ok := m.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpcHttp3ClientStream: cannot receive into %T", m)
+	}
+
+	if s.body == nil {
+		select {
+		case response := <-s.responses:
+			s.body = response.Body
+			if response.StatusCode != http.StatusOK {
+				response.Body.Close()
+				return status.Errorf(codes.Unknown, "unexpected HTTP status %s", response.Status)
+			}
+			if code := response.Header.Get("Grpc-Status"); code != "" && code != "0" {
+				response.Body.Close()
+				value, _ := strconv.Atoi(code)
+				return status.Error(codes.Code(value), response.Header.Get("Grpc-Message"))
+			}
+		case err := <-s.errors:
+			return err
+		}
+	}
+
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(s.body, prefix); err != nil {
+		if err == io.EOF {
+			s.body.Close()
+		}
+		return err
+	}
+
+	*message = make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(s.body, *message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2.Transport only does h2c with prior knowledge, so the Upgrade variant
+// sends its first request as HTTP/1.1 with "Upgrade: h2c", and then runs the
+// connection with the minimal HTTP/2 client from websocket_h2.go. The answer to
+// the upgrade request arrives on stream 1, see server/h2c.go.
+type h2cUpgradeTransport struct {
+	addr string
+
+	mu           sync.Mutex // guards the connection, and opens streams in order
+	conn         net.Conn
+	h2           *h2Conn
+	done         chan struct{}
+	nextStreamID uint32
+
+	responsesMu sync.Mutex
+	responses   map[uint32]chan []hpack.HeaderField
+}
+
+type h2cResponseBody struct {
+	stream *h2Stream
+}
+
+// bufferedConn reads through the reader that parsed the 101 response, which may hold early frames.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func newH2cUpgradeTransport(host string, port int) *h2cUpgradeTransport {
+	return &h2cUpgradeTransport{addr: fmt.Sprintf("%s:%d", host, port)}
+}
+
+// The HTTP2-Settings header holds the payload of the SETTINGS frame we would have sent.
+func h2cSettingsHeader() string {
+	frame := &bytes.Buffer{}
+	http2.NewFramer(frame, nil).WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2WindowSize})
+	return base64.RawURLEncoding.EncodeToString(frame.Bytes()[9:])
+}
+
+func (t *h2cUpgradeTransport) onHeaders(streamID uint32, fields []hpack.HeaderField) {
+	t.responsesMu.Lock()
+	defer t.responsesMu.Unlock()
+
+	// Only the first header block is the response, the echo server sends no trailers.
+	if responses, ok := t.responses[streamID]; ok {
+		responses <- fields
+		delete(t.responses, streamID)
+	}
+}
+
+func (t *h2cUpgradeTransport) expectResponse(streamID uint32) chan []hpack.HeaderField {
+	t.responsesMu.Lock()
+	defer t.responsesMu.Unlock()
+
+	responses := make(chan []hpack.HeaderField, 1)
+	t.responses[streamID] = responses
+	return responses
+}
+
+// Send request as an HTTP/1.1 upgrade, and switch the connection to HTTP/2 with stream 1 waiting for its response.
+func (t *h2cUpgradeTransport) upgrade(request *http.Request) (*h2Stream, chan []hpack.HeaderField, error) {
+	conn, err := tcpTuning.dial("tcp", t.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upgradeRequest := request.Clone(request.Context())
+	upgradeRequest.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	upgradeRequest.Header.Set("Upgrade", "h2c")
+	upgradeRequest.Header.Set("HTTP2-Settings", h2cSettingsHeader())
+
+	writer := bufio.NewWriter(conn)
+	if err := upgradeRequest.Write(writer); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, upgradeRequest)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		conn.Close()
+		return nil, nil, fmt.Errorf("h2c: server did not upgrade, answered %s", response.Status)
+	}
+
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	t.responses = make(map[uint32]chan []hpack.HeaderField)
+	c := newH2Conn(&bufferedConn{Conn: conn, reader: reader}, t.onHeaders)
+	stream := c.newStream(1)
+	responses := t.expectResponse(1)
+	if err := c.writeSettings(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.readLoop()
+		conn.Close()
+		close(done)
+	}()
+
+	t.conn = conn
+	t.h2 = c
+	t.done = done
+	t.nextStreamID = 3
+	return stream, responses, nil
+}
+
+// Open a new stream for request, sending its headers and body.
+func (t *h2cUpgradeTransport) send(request *http.Request) (*h2Stream, chan []hpack.HeaderField, error) {
+	t.mu.Lock()
+	c := t.h2
+	if c == nil {
+		t.mu.Unlock()
+		return nil, nil, errors.New("h2c: connection was closed")
+	}
+	stream := c.newStream(t.nextStreamID)
+	t.nextStreamID += 2
+	responses := t.expectResponse(stream.id)
+
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: request.Method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: t.addr},
+		{Name: ":path", Value: request.URL.RequestURI()},
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		fields = append(fields, hpack.HeaderField{Name: "content-type", Value: contentType})
+	}
+	if request.ContentLength > 0 {
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.FormatInt(request.ContentLength, 10)})
+	}
+	err := c.writeHeaders(stream.id, fields, request.Body == nil)
+	t.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if request.Body != nil {
+		if _, err := io.Copy(stream, request.Body); err != nil {
+			return nil, nil, err
+		}
+		if err := stream.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return stream, responses, nil
+}
+
+func (t *h2cUpgradeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		defer request.Body.Close()
+	}
+
+	var stream *h2Stream
+	var responses chan []hpack.HeaderField
+	var err error
+
+	t.mu.Lock()
+	upgraded := t.h2 != nil
+	if !upgraded {
+		stream, responses, err = t.upgrade(request)
+	}
+	c, done := t.h2, t.done
+	t.mu.Unlock()
+	if upgraded {
+		stream, responses, err = t.send(request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []hpack.HeaderField
+	select {
+	case fields = <-responses:
+	case <-done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.closeErr
+	}
+
+	response := &http.Response{
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(http.Header),
+		Body:          &h2cResponseBody{stream: stream},
+		ContentLength: -1,
+		Request:       request,
+	}
+	for _, field := range fields {
+		if field.Name == ":status" {
+			response.StatusCode, _ = strconv.Atoi(field.Value)
+			response.Status = fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode))
+		} else {
+			response.Header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+		}
+	}
+	if response.StatusCode == 0 {
+		return nil, errors.New("h2c: response without :status")
+	}
+	return response, nil
+}
+
+// CloseIdleConnections drops the connection, so the next request upgrades a new one.
+func (t *h2cUpgradeTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		<-t.done
+		t.conn = nil
+		t.h2 = nil
+	}
+}
+
+func (b *h2cResponseBody) Read(buf []byte) (int, error) {
+	return b.stream.Read(buf)
+}
+
+// Close forgets the stream, data still arriving for it is credited back by the read loop.
+func (b *h2cResponseBody) Close() error {
+	c := b.stream.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.streams, b.stream.id)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The parts of a HAR 1.2 file (as exported by browsers) that shape a page
+// load. Chrome adds the initiator and priority of every request.
+type harFile struct {
+	Log struct {
+		Pages []struct {
+			Title string `json:"title"`
+		} `json:"pages"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		URL string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status   int `json:"status"`
+		BodySize int `json:"bodySize"`
+		Content  struct {
+			Size     int    `json:"size"`
+			MimeType string `json:"mimeType"`
+		} `json:"content"`
+	} `json:"response"`
+	Initiator *harInitiator `json:"_initiator"`
+	Priority  string        `json:"_priority"`
+}
+
+type harInitiator struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Stack *struct {
+		CallFrames []struct {
+			URL string `json:"url"`
+		} `json:"callFrames"`
+		Parent *struct {
+			CallFrames []struct {
+				URL string `json:"url"`
+			} `json:"callFrames"`
+		} `json:"parent"`
+	} `json:"stack"`
+}
+
+// The URL of the resource that caused the request, if the HAR says.
+func (i *harInitiator) parentURL() string {
+	if i == nil {
+		return ""
+	}
+	if i.URL != "" {
+		return i.URL
+	}
+	if i.Stack != nil {
+		for _, frame := range i.Stack.CallFrames {
+			if frame.URL != "" {
+				return frame.URL
+			}
+		}
+		if i.Stack.Parent != nil {
+			for _, frame := range i.Stack.Parent.CallFrames {
+				if frame.URL != "" {
+					return frame.URL
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Bytes on the wire when known (none for cache hits), the decoded size otherwise.
+func (e *harEntry) size() int {
+	if e.Response.BodySize >= 0 {
+		return e.Response.BodySize
+	}
+	if e.Response.Content.Size > 0 {
+		return e.Response.Content.Size
+	}
+	return 0
+}
+
+// Convert a HAR file into a page manifest: resources in request order, each with the
+// resource that initiated it as parent. Requests with no known initiator hang off the
+// root document, which is the first request.
+func importHar(fileName string) (*pageManifest, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	har := &harFile{}
+	if err := json.Unmarshal(data, har); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+
+	entries := make([]harEntry, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		url := entry.Request.URL
+		if entry.Response.Status == 0 || !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+			continue // failed or blocked requests, and data: or blob: URLs
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no completed HTTP requests", fileName)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedDateTime.Before(entries[j].StartedDateTime) })
+
+	manifest := &pageManifest{Name: strings.TrimSuffix(fileName, ".har")}
+	if len(har.Log.Pages) > 0 && har.Log.Pages[0].Title != "" {
+		manifest.Name = har.Log.Pages[0].Title
+	}
+
+	// The same URL can be requested more than once, the manifest needs unique paths.
+	pathOf := make(map[string]string) // first path given to each URL
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		url := entry.Request.URL
+		path := url
+		if seen[url] > 0 {
+			path = fmt.Sprintf("%s#%d", url, seen[url]+1)
+		}
+		seen[url]++
+		if _, ok := pathOf[url]; !ok {
+			pathOf[url] = path
+		}
+
+		resource := pageResource{
+			Path:        path,
+			Size:        entry.size(),
+			ContentType: entry.Response.Content.MimeType,
+			Priority:    entry.Priority,
+		}
+		if i > 0 {
+			// A parent requested later than its child can't be waited for, so fall back to the root.
+			resource.Parent = manifest.Resources[0].Path
+			if parent, ok := pathOf[entry.Initiator.parentURL()]; ok && parent != path {
+				resource.Parent = parent
+			}
+		}
+		manifest.Resources = append(manifest.Resources, resource)
+	}
+
+	return manifest, nil
+}
+
+// Write manifest as indented JSON to fileName, or to stdout if it's empty.
+func writePageManifest(manifest *pageManifest, fileName string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if fileName == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
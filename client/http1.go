@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+)
+
+// How HTTP/1.1 connections are used, next to the sequential keep-alive of clientHttpMain.
+const (
+	httpPool        = "Pool"          // files sent concurrently over up to N keep-alive connections
+	httpNoKeepAlive = "No Keep-Alive" // a new connection for every request
+	httpPipelining  = "Pipelining"    // all requests written back to back on one connection
+)
+
+// http1PipelineConn sends pipelined requests on a raw connection, as http.Transport never pipelines.
+type http1PipelineConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	host   string
+}
+
+func dialHttp1Pipeline(host string, port int, useTls bool) (*http1PipelineConn, error) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	var conn net.Conn
+	var err error
+	if useTls {
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		}
+		conn, err = tcpTuning.dialTls("tcp", addr, tlsConf)
+	} else {
+		conn, err = tcpTuning.dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &http1PipelineConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriterSize(conn, bufferMaxSize),
+		host:   addr,
+	}, nil
+}
+
+func (p *http1PipelineConn) writeRequest(data []byte) error {
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/", p.host), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	return request.Write(p.writer)
+}
+
+// Read one response and check the server saw size bytes.
+func (p *http1PipelineConn) readResponse(size int) error {
+	response, err := http.ReadResponse(p.reader, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP/1 pipelining: server answered %s", response.Status)
+	}
+	if received := parseAck(body); received != size {
+		return fmt.Errorf("HTTP/1 pipelining: %d did not finish, server saw %d", size, received)
+	}
+	return nil
+}
+
+// Write all requests before the first response is read, reading responses as they come back.
+// The sampler, if any, counts the bytes of every request acknowledged so far.
+func (p *http1PipelineConn) flood(data []byte, requests int, sampler *transferSampler) error {
+	writeErr := goWorker(func() error {
+		for i := 0; i < requests; i++ {
+			if err := p.writeRequest(data); err != nil {
+				return err
+			}
+		}
+		return p.writer.Flush()
+	})
+
+	for i := 0; i < requests; i++ {
+		if err := p.readResponse(len(data)); err != nil {
+			p.conn.Close() // unblocks the writer
+			<-writeErr
+			return err
+		}
+		sampler.add(len(data))
+	}
+	return <-writeErr
+}
+
+func (p *http1PipelineConn) Close() error {
+	return p.conn.Close()
+}
+
+// Send files concurrently, one goroutine per file, returning the first error.
+func floodHttpConcurrent(protocol string, environment string, size int, sizeIndex int, client *http.Client, url string, files int) error {
+	var workers []<-chan error
+	for fileNum := 0; fileNum < files; fileNum++ {
+		workers = append(workers, goWorker(func() error {
+			return floodHttp(protocol, environment, size, sizeIndex, client, url)
+		}))
+	}
+	return waitWorkers(workers)
+}
+
+// HTTP/1.1 as browsers and proxies use it: pooled connections, no keep-alive, or pipelining
+func clientHttp1Main(environment string, host string, port int, useTls bool, mode string, connections int) error {
+	fmt.Printf("Testing HTTP (%s)...\n", mode)
+	protocolName := "HTTP/1" // for report and logging strings
+	url := fmt.Sprintf("http://%s:%d/", host, port)
+
+	customTransport := newHttpTransport()
+	if useTls {
+		protocolName += " (TLS)"
+		url = fmt.Sprintf("https://%s:%d/", host, port)
+		customTransport = newHttp1TlsTransport()
+	}
+
+	switch mode {
+	case httpPool:
+		protocolName += fmt.Sprintf(" (Pool %d)", connections)
+		customTransport.MaxConnsPerHost = connections
+		customTransport.MaxIdleConnsPerHost = connections
+	case httpNoKeepAlive:
+		protocolName += " (No Keep-Alive)"
+		customTransport.DisableKeepAlives = true
+	case httpPipelining:
+		protocolName += " (Pipelining)"
+	default:
+		return fmt.Errorf("unknown HTTP/1 mode %q", mode)
+	}
+
+	size := initialMessageSize
+	sizeIndex := 0
+	for size <= finalMessageSize {
+		memoryBefore, err2 := memory.Get()
+		if err2 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err2)
+			return err2
+		}
+
+		cpuBefore, err1 := cpu.Get()
+		if err1 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err1)
+			return err1
+		}
+
+		var setupDuration, firstByteDuration, duration time.Duration
+		var err error
+
+		start := time.Now()
+		if mode == httpPipelining {
+			var pipeline *http1PipelineConn
+			pipeline, err = dialHttp1Pipeline(host, port, useTls)
+			if err != nil {
+				return err
+			}
+			setupDuration = time.Since(start)
+			if err = pipeline.flood(httpByteBuffer[0], 1, nil); err == nil {
+				firstByteDuration = time.Since(start)
+
+				floodStart := time.Now()
+				sampler := startSampler(protocolName, environment, measureAcknowledged, size)
+				err = pipeline.flood(httpByteBuffer[sizeIndex], filesToSend, sampler)
+				sampler.finish(err == nil)
+				duration = time.Since(floodStart)
+			}
+			pipeline.Close()
+		} else {
+			client := &http.Client{Transport: customTransport}
+			setupDuration = time.Since(start)
+			getFirstByteHttp(protocolName, environment, client, url)
+			firstByteDuration = time.Since(start)
+
+			floodStart := time.Now()
+			if mode == httpPool {
+				err = floodHttpConcurrent(protocolName, environment, size, sizeIndex, client, url, filesToSend)
+			} else {
+				for fileNum := 0; fileNum < filesToSend && err == nil; fileNum++ {
+					err = floodHttp(protocolName, environment, size, sizeIndex, client, url)
+				}
+			}
+			duration = time.Since(floodStart)
+			client.CloseIdleConnections()
+		}
+
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			cpuAfter, err1 := cpu.Get()
+			if err1 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err1)
+				return err1
+			}
+			memoryAfter, err2 := memory.Get()
+			if err2 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err2)
+				return err2
+			}
+			report(protocolName, environment, "HTTP", filesToSend, setupDuration, firstByteDuration, size, duration, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+		}
+
+		size *= 2
+		sizeIndex++
+	}
+	return nil
+}
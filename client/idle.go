@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The idle benchmark holds a growing number of connections open with nothing
+// on them but keepalives, and after each step compares the memory and
+// goroutines of client and server with what they used before the first
+// connection. Like the churn benchmark it connects to the RPC servers for TCP,
+// TLS and QUIC, and to the HTTP/3 server, which is asked for nothing once so
+// that every connection has HTTP/3 set up before it idles.
+const (
+	idleKeepAlive   = 15 * time.Second // TCP keepalive period, QUIC pings at half its idle timeout
+	idleDialWorkers = 64               // connections opened at once while growing to the next step
+
+	idleSettleDelay    = 6 * time.Second // quic-go keeps closed sessions for 5s to repeat their CONNECTION_CLOSE
+	idleSettleInterval = time.Second     // between samples while waiting for earlier connections to go away
+	idleSettleTimeout  = 30 * time.Second
+)
+
+// An open connection, and a channel closed once it's gone.
+type idleConnection struct {
+	closer io.Closer
+	done   <-chan struct{}
+}
+
+func (c *idleConnection) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func dialIdleConnection(protocol string, addr string) (*idleConnection, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+
+	switch protocol {
+	case rpcTcp, rpcTcpTls:
+		dialer := tcpTuning.dialer()
+		dialer.KeepAlive = idleKeepAlive
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tcpTuning.tune(conn)
+		if protocol == rpcTcpTls {
+			tlsConn := tls.Client(conn, tlsConf)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		// The server never writes unasked, so the read only returns once the connection is gone.
+		done := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			close(done)
+		}()
+		return &idleConnection{closer: conn, done: done}, nil
+	case rpcQuic:
+		session, err := quicImplementation.dial(addr, tlsConf, quicTuning.options(quicOptions{keepAlive: true}))
+		if err != nil {
+			return nil, err
+		}
+		return &idleConnection{closer: closeSession{session}, done: session.Context().Done()}, nil
+	case httpVariantHttp3:
+		var done <-chan struct{}
+		options := quicTuning.options(quicOptions{keepAlive: true})
+		options.connected = func(ctx context.Context) {
+			done = ctx.Done()
+		}
+		transport := quicImplementation.http3Transport(tlsConf, options)
+		closer, ok := transport.(io.Closer)
+		if !ok {
+			return nil, fmt.Errorf("HTTP/3 transport of %s can't be closed", quicImplementation)
+		}
+		response, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://%s/bytes/0", addr))
+		if err == nil {
+			err = readHttpBody(response, 0)
+		}
+		if err == nil && done == nil {
+			err = fmt.Errorf("HTTP/3 transport of %s didn't report its connection", quicImplementation)
+		}
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		return &idleConnection{closer: closer, done: done}, nil
+	}
+	return nil, fmt.Errorf("unknown idle protocol %q", protocol)
+}
+
+type closeSession struct {
+	session quicSession
+}
+
+func (c closeSession) Close() error {
+	return c.session.CloseWithError(0, "")
+}
+
+// Parse a comma separated list of connection counts, in the order they're reached.
+func parseIdleSteps(spec string) ([]int, error) {
+	var steps []int
+	for _, field := range strings.Split(spec, ",") {
+		step, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid idle connection count %q", field)
+		}
+		steps = append(steps, step)
+	}
+	if !sort.IntsAreSorted(steps) {
+		return nil, fmt.Errorf("idle connection counts %q must grow", spec)
+	}
+	return steps, nil
+}
+
+// Every connection takes a file descriptor, so allow as many as the hard limit does.
+func raiseFileLimit() {
+	var limit syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit) == nil && limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+}
+
+// Memory and goroutines of the client and the server at one step.
+type idleSample struct {
+	connections int // still open at the end of the hold
+	failures    int // connections that couldn't be opened
+	client      *processStats
+	server      *processStats
+}
+
+// The growth of a stat over the baseline, per connection.
+func perConnection(value uint64, baseline uint64, connections int) int64 {
+	if connections == 0 {
+		return 0
+	}
+	return (int64(value) - int64(baseline)) / int64(connections)
+}
+
+// Append a step of the idle benchmark to the idle file of the environment
+func reportIdle(protocol string, environment string, target int, baseline *idleSample, sample *idleSample) {
+	clientHeap := perConnection(sample.client.HeapBytes, baseline.client.HeapBytes, sample.connections)
+	clientRss := perConnection(sample.client.RssBytes, baseline.client.RssBytes, sample.connections)
+	serverHeap := perConnection(sample.server.HeapBytes, baseline.server.HeapBytes, sample.connections)
+	serverRss := perConnection(sample.server.RssBytes, baseline.server.RssBytes, sample.connections)
+	fmt.Printf("[%s - %s] %d/%d connections (%d failed), client: %d goroutines, %s heap, %d b/connection, server: %d goroutines, %s heap, %d b/connection\n", protocol, environment, sample.connections, target, sample.failures, sample.client.Goroutines, getSizeString(int(sample.client.HeapBytes)), clientHeap, sample.server.Goroutines, getSizeString(int(sample.server.HeapBytes)), serverHeap)
+
+	fileName := outputFile("idle", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%d,%d,%d,", protocol, environment, target, sample.connections, sample.failures))
+	f.WriteString(fmt.Sprintf("%d,%d,%d,", sample.client.Goroutines, sample.client.HeapBytes, sample.client.RssBytes))
+	f.WriteString(fmt.Sprintf("%d,%d,%d,", sample.server.Goroutines, sample.server.HeapBytes, sample.server.RssBytes))
+	f.WriteString(fmt.Sprintf("%d,%d,%d,%d", clientHeap, clientRss, serverHeap, serverRss))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
+
+// Whether a process let go of goroutines or more than 1% of its heap between two samples.
+func shrinking(previous *processStats, current *processStats) bool {
+	return current.Goroutines < previous.Goroutines || current.HeapBytes < previous.HeapBytes-previous.HeapBytes/100
+}
+
+// Sample client and server once the connections of earlier tests are gone, which
+// takes a while for QUIC as closed sessions linger to answer retransmissions.
+func settledSample(host string, httpPort int) (*idleSample, error) {
+	time.Sleep(idleSettleDelay)
+	sample := &idleSample{}
+	for start := time.Now(); time.Since(start) < idleSettleTimeout; time.Sleep(idleSettleInterval) {
+		server, err := fetchServerStats(host, httpPort, true)
+		if err != nil {
+			return nil, err
+		}
+		client := localStats()
+		settled := sample.server != nil && !shrinking(sample.server, server) && !shrinking(sample.client, client)
+		sample.client, sample.server = client, server
+		if settled {
+			break
+		}
+	}
+	return sample, nil
+}
+
+// Hold steps of idle connections over one protocol, each for hold. httpPort is where the server's stats are read.
+func clientIdleMain(environment string, host string, port int, httpPort int, protocol string, steps []int, hold time.Duration) error {
+	fmt.Printf("Testing %s idle connections %v...\n", protocol, steps)
+	protocolName := fmt.Sprintf("%s Idle", protocol) // for report and logging strings
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	baseline, err := settledSample(host, httpPort)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var connections []*idleConnection
+	defer func() {
+		for _, connection := range connections {
+			connection.closer.Close()
+		}
+	}()
+
+	for _, target := range steps {
+		// Open what's missing, a few at a time
+		failures := 0
+		missing := target - len(connections)
+		if missing < 0 {
+			missing = 0
+		}
+		toOpen := make(chan struct{}, missing) // filled up front, so workers that die can't block it
+		for i := 0; i < missing; i++ {
+			toOpen <- struct{}{}
+		}
+		close(toOpen)
+		var workers []<-chan error
+		for i := 0; i < idleDialWorkers; i++ {
+			workers = append(workers, goWorker(func() error {
+				for range toOpen {
+					connection, err := dialIdleConnection(protocol, addr)
+					mu.Lock()
+					if err != nil {
+						failures++
+					} else {
+						connections = append(connections, connection)
+					}
+					mu.Unlock()
+				}
+				return nil
+			}))
+		}
+		if err := waitWorkers(workers); err != nil {
+			return err
+		}
+
+		time.Sleep(hold)
+
+		// Drop what died while idle
+		alive := connections[:0]
+		for _, connection := range connections {
+			if connection.alive() {
+				alive = append(alive, connection)
+			} else {
+				connection.closer.Close()
+			}
+		}
+		connections = alive
+
+		serverStats, err := fetchServerStats(host, httpPort, true)
+		if err != nil {
+			return err
+		}
+		sample := &idleSample{connections: len(connections), failures: failures, client: localStats(), server: serverStats}
+		reportIdle(protocolName, environment, target, baseline, sample)
+	}
+	return nil
+}
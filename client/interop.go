@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interop mode downloads and uploads with plain GET and POST against any HTTP
+// server, ours (see server/workloads.go) or another implementation, instead of
+// relying on the 8-byte length our server answers uploads with. The server's
+// Server header stands for its implementation in the results.
+const interopSizePlaceholder = "{size}"
+
+type interopConfig struct {
+	target       *url.URL // scheme, host and port of the server
+	downloadPath string   // GET path, where {size} is replaced by the bytes asked for
+	uploadPath   string   // POST path, no uploads if empty
+	sizes        []int
+	protocols    []string // h1, h2 or h3
+}
+
+// The HTTP variant of protocol given the scheme of the target: h1 and h2 go in the clear over http.
+func interopVariant(protocol string, scheme string) (string, error) {
+	switch {
+	case protocol == "h1" && scheme == "http":
+		return httpVariantHttp1, nil
+	case protocol == "h1" && scheme == "https":
+		return httpVariantHttp1Tls, nil
+	case protocol == "h2" && scheme == "http":
+		return httpVariantH2c, nil
+	case protocol == "h2" && scheme == "https":
+		return httpVariantHttp2, nil
+	case protocol == "h3" && scheme == "https":
+		return httpVariantHttp3, nil
+	}
+	return "", fmt.Errorf("no interop protocol %q over %s", protocol, scheme)
+}
+
+func parseInteropConfig(target string, downloadPath string, uploadPath string, sizes string, protocols string) (*interopConfig, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("interop target %q must be an http or https URL", target)
+	}
+	config := &interopConfig{target: parsed, downloadPath: downloadPath, uploadPath: uploadPath}
+
+	for _, field := range strings.Split(sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size <= 0 || size > finalMessageSize {
+			return nil, fmt.Errorf("invalid interop size %q, expected 1 to %d bytes", field, finalMessageSize)
+		}
+		config.sizes = append(config.sizes, size)
+	}
+	for _, field := range strings.Split(protocols, ",") {
+		protocol := strings.TrimSpace(field)
+		if _, err := interopVariant(protocol, parsed.Scheme); err != nil {
+			return nil, err
+		}
+		config.protocols = append(config.protocols, protocol)
+	}
+	return config, nil
+}
+
+// host:port of the target, with the default port of its scheme if it has none.
+func (c *interopConfig) address() (string, int, error) {
+	port := c.target.Port()
+	if port == "" {
+		port = "80"
+		if c.target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portNumber, err := strconv.Atoi(port)
+	return c.target.Hostname(), portNumber, err
+}
+
+// The URL of path under the target, with size in place of {size}.
+func (c *interopConfig) url(path string, size int) string {
+	prefix := c.target.Scheme + "://" + c.target.Host + strings.TrimSuffix(c.target.Path, "/")
+	return prefix + strings.Replace(path, interopSizePlaceholder, strconv.Itoa(size), -1)
+}
+
+// Read a response to the end, returning the body bytes and the Server header.
+func readInteropResponse(response *http.Response, err error) (int, string, error) {
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+
+	received, err := io.Copy(ioutil.Discard, response.Body)
+	if err != nil {
+		return int(received), "", err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return int(received), "", fmt.Errorf("%s answered %s", response.Request.URL, response.Status)
+	}
+	return int(received), response.Header.Get("Server"), nil
+}
+
+// Download size bytes, checking they all came when the path asks for a size.
+func interopDownload(client *http.Client, config *interopConfig, size int) (int, string, error) {
+	received, server, err := readInteropResponse(client.Get(config.url(config.downloadPath, size)))
+	if err == nil && strings.Contains(config.downloadPath, interopSizePlaceholder) && received != size {
+		err = fmt.Errorf("%s: %d did not finish, received %d", config.downloadPath, size, received)
+	}
+	return received, server, err
+}
+
+func interopUpload(client *http.Client, config *interopConfig, size int) (int, string, error) {
+	request, err := http.NewRequest(http.MethodPost, config.url(config.uploadPath, size), bytes.NewReader(dataBuffer[:size]))
+	if err != nil {
+		return 0, "", err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	_, server, err := readInteropResponse(client.Do(request))
+	return size, server, err
+}
+
+// The Server header of the interop target's answers, recorded with results,
+// "-" for results of our own server.
+var interopServer = "-"
+
+// Transfer filesToSend times in a row over one client, reporting the latency of every transfer.
+func runInterop(protocolName string, environment string, kind string, client *http.Client, config *interopConfig, size int,
+	transfer func(client *http.Client, config *interopConfig, size int) (int, string, error)) error {
+	var latencies []time.Duration
+	transferred := 0
+	runStart := time.Now()
+	for fileNum := 0; fileNum < filesToSend; fileNum++ {
+		start := time.Now()
+		received, server, err := transfer(client, config, size)
+		if err != nil {
+			return err
+		}
+		latencies = append(latencies, time.Since(start))
+		transferred += received
+		if server != "" {
+			interopServer = strings.ReplaceAll(server, ",", " ")
+		}
+	}
+	duration := time.Since(runStart)
+
+	fmt.Printf("[%s - %s] %s, goodput: %.0f kbps (server: %s)\n", protocolName, environment, getSizeString(transferred/filesToSend), float64(transferred)*8/1000/duration.Seconds(), interopServer)
+	reportLatencies(protocolName, environment, kind, transferred/filesToSend, latencies, duration)
+	return nil
+}
+
+// Download, then upload, every size over every protocol of the config.
+func clientInteropMain(environment string, config *interopConfig) error {
+	host, port, err := config.address()
+	if err != nil {
+		return err
+	}
+	interopServer = "unknown"
+
+	// A failed transfer doesn't stop the others, but fails the measurement.
+	var firstErr error
+	for _, protocol := range config.protocols {
+		variant, _ := interopVariant(protocol, config.target.Scheme)
+		fmt.Printf("Testing %s interop with %s...\n", variant, config.target.Host)
+		protocolName := fmt.Sprintf("%s Interop %s", variant, config.target.Host) // for report and logging strings
+
+		transport, _, err := newWorkloadTransport(variant, host, port)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: transport}
+
+		// A download path without a size serves the same resource whatever the size, so it's fetched once.
+		for i, size := range config.sizes {
+			if i == 0 || strings.Contains(config.downloadPath, interopSizePlaceholder) {
+				if err := runInterop(protocolName, environment, "Interop Download", client, config, size, interopDownload); err != nil {
+					fmt.Println(err)
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+			if config.uploadPath == "" {
+				continue
+			}
+			if err := runInterop(protocolName, environment, "Interop Upload", client, config, size, interopUpload); err != nil {
+				fmt.Println(err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+
+		client.CloseIdleConnections()
+		if closer, ok := transport.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return firstErr
+}
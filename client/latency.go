@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Return the latency at percentile p (0-100) of already sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(p / 100.0 * float64(len(sorted)-1))
+	return sorted[index]
+}
+
+// Summarize per-request latencies and append the distribution to the latency file of the environment
+func reportLatencies(protocol string, environment string, kind string, size int, latencies []time.Duration, duration time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+	mean := total / time.Duration(len(sorted))
+	throughput := float64(len(sorted)) / duration.Seconds()
+
+	fileSizeStr := getSizeString(size)
+	p50 := percentile(sorted, 50)
+	p90 := percentile(sorted, 90)
+	p99 := percentile(sorted, 99)
+	max := sorted[len(sorted)-1]
+
+	fmt.Printf("[%s - %s] [%d requests] size: %s, mean: %s, p50: %s, p90: %s, p99: %s, max: %s (%.1f req/s)\n", protocol, environment, len(sorted), fileSizeStr, mean, p50, p90, p99, max, throughput)
+
+	fileName := outputFile("latency", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%s,%s,%d,", protocol, kind, environment, fileSizeStr, len(sorted)))
+	f.WriteString(fmt.Sprintf("%d,%d,%d,%d,%d,", mean.Microseconds(), p50.Microseconds(), p90.Microseconds(), p99.Microseconds(), max.Microseconds()))
+	f.WriteString(fmt.Sprintf("%f", throughput))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
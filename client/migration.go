@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The migration benchmark downloads a response and changes the client's
+// address halfway through. QUIC keeps its session: either the client moves to
+// a new UDP socket, or (through the local relay) a NAT in front of it picks a
+// new port. TCP can't survive either, so it reconnects and asks for the rest.
+// QUIC talks to the server's migration port (see server/migration.go), TCP to
+// the RPC server.
+const (
+	migrationQuic      = "QUIC"
+	migrationQuicRelay = "QUIC (relay)"
+	migrationTcp       = "TCP"
+)
+
+// Give up on a session that hears nothing for this long, as it didn't survive the change.
+const migrationIdleTimeout = 5 * time.Second
+
+// rebindingConn is a UDP socket that can move to a new local port while in use.
+type rebindingConn struct {
+	mu         sync.Mutex
+	conn       net.PacketConn
+	readBuffer int // applied to new sockets too, once set
+}
+
+func listenRebinding() (*rebindingConn, error) {
+	conn, err := udpTuning.listenUdp(":0")
+	if err != nil {
+		return nil, err
+	}
+	return &rebindingConn{conn: conn}, nil
+}
+
+func (c *rebindingConn) current() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Move to a new socket, closing the old one.
+func (c *rebindingConn) rebind() error {
+	conn, err := udpTuning.listenUdp(":0")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.conn
+	c.conn = conn
+	if c.readBuffer > 0 {
+		udpTuning.setReadBuffer(conn, c.readBuffer)
+	}
+	c.mu.Unlock()
+	return old.Close()
+}
+
+func (c *rebindingConn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBuffer = bytes
+	return udpTuning.setReadBuffer(c.conn.(*net.UDPConn), bytes)
+}
+
+func (c *rebindingConn) SyscallConn() (syscall.RawConn, error) {
+	return c.current().(*net.UDPConn).SyscallConn()
+}
+
+func (c *rebindingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(p)
+		if err != nil && conn != c.current() {
+			continue // closed by a rebind, read from the new socket
+		}
+		return n, addr, err
+	}
+}
+
+func (c *rebindingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.current().WriteTo(p, addr)
+}
+
+func (c *rebindingConn) Close() error                       { return c.current().Close() }
+func (c *rebindingConn) LocalAddr() net.Addr                { return c.current().LocalAddr() }
+func (c *rebindingConn) SetDeadline(t time.Time) error      { return c.current().SetDeadline(t) }
+func (c *rebindingConn) SetReadDeadline(t time.Time) error  { return c.current().SetReadDeadline(t) }
+func (c *rebindingConn) SetWriteDeadline(t time.Time) error { return c.current().SetWriteDeadline(t) }
+
+// udpRelay forwards datagrams between a local client and the server like a NAT,
+// and can move to a new port on the server's side.
+type udpRelay struct {
+	listener net.PacketConn // where the client sends to
+	server   net.Addr
+
+	mu       sync.Mutex
+	upstream *rebindingConn // where the server sends to
+	client   net.Addr
+}
+
+func newUdpRelay(serverAddr string) (*udpRelay, error) {
+	server, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := listenRebinding()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	r := &udpRelay{listener: listener, server: server, upstream: upstream}
+	go r.forward(listener, func(p []byte, from net.Addr) {
+		r.mu.Lock()
+		r.client = from
+		r.mu.Unlock()
+		upstream.WriteTo(p, server)
+	})
+	go r.forward(upstream, func(p []byte, from net.Addr) {
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		if client != nil {
+			listener.WriteTo(p, client)
+		}
+	})
+	return r, nil
+}
+
+// Hand every datagram read from conn to send, until conn is closed.
+func (r *udpRelay) forward(conn net.PacketConn, send func(p []byte, from net.Addr)) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		send(buf[:n], from)
+	}
+}
+
+func (r *udpRelay) rebind() error {
+	return r.upstream.rebind()
+}
+
+func (r *udpRelay) Close() error {
+	r.upstream.Close()
+	return r.listener.Close()
+}
+
+// How a download fared across the address change.
+type migrationResult struct {
+	stall      time.Duration // longest gap between reads after the change
+	rateBefore float64       // bytes per second up to the change
+	rateAfter  float64       // bytes per second from the change to the end
+	duration   time.Duration
+}
+
+// Read size bytes from reader, calling rebind to change address once half has arrived.
+// rebind returns where to read the rest from.
+func migrationTransfer(reader io.Reader, size int, rebind func(received int) (io.Reader, error)) (*migrationResult, error) {
+	result := &migrationResult{}
+	buf := make([]byte, 65536)
+	received := 0
+	start := time.Now()
+	var changed time.Time
+	receivedBefore := 0
+	lastRead := start
+
+	for received < size {
+		if changed.IsZero() && received >= size/2 {
+			var err error
+			if reader, err = rebind(received); err != nil {
+				return nil, err
+			}
+			changed = time.Now()
+			lastRead = changed
+			receivedBefore = received
+			result.rateBefore = float64(received) / changed.Sub(start).Seconds()
+		}
+
+		n, err := reader.Read(buf[:min(len(buf), size-received)])
+		received += n
+		now := time.Now()
+		if !changed.IsZero() && now.Sub(lastRead) > result.stall {
+			result.stall = now.Sub(lastRead)
+		}
+		lastRead = now
+		if err != nil && received < size {
+			return nil, fmt.Errorf("after %d of %d bytes: %s", received, size, err)
+		}
+	}
+
+	result.duration = time.Since(start)
+	result.rateAfter = float64(size-receivedBefore) / time.Since(changed).Seconds()
+	return result, nil
+}
+
+// Download size bytes over QUIC, moving to a new socket (or the relay to a new port) halfway.
+func quicMigration(addr string, host string, size int, viaRelay bool) (*migrationResult, error) {
+	conn, err := listenRebinding()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rebind := conn.rebind
+
+	dialAddr := addr
+	if viaRelay {
+		relay, err := newUdpRelay(addr)
+		if err != nil {
+			return nil, err
+		}
+		defer relay.Close()
+		dialAddr = relay.listener.LocalAddr().String()
+		rebind = relay.rebind
+	}
+	remote, err := net.ResolveUDPAddr("udp", dialAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+	session, err := quic.Dial(conn, remote, host, tlsConf, legacyQuicConfig(quicTuning.options(quicOptions{idleTimeout: migrationIdleTimeout, datagrams: true})))
+	if err != nil {
+		return nil, err
+	}
+	defer session.CloseWithError(0, "")
+
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRpcRequest(stream, 0, size); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	return migrationTransfer(stream, size, func(received int) (io.Reader, error) {
+		if err := rebind(); err != nil {
+			return nil, err
+		}
+		// A receiving client may have nothing to send, and the server only learns the new address from
+		// a packet. quic-go can't probe the new path the way a migrating client would, so send a datagram
+		// (when the server doesn't take them, it hears from the client only once it has something to ack).
+		session.SendMessage([]byte{0})
+		return stream, nil
+	})
+}
+
+// Download size bytes over TCP, reconnecting halfway and asking for what's left.
+func tcpMigration(addr string, size int) (*migrationResult, error) {
+	conn, err := tcpTuning.dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { conn.Close() }()
+	if err := writeRpcRequest(conn, 0, size); err != nil {
+		return nil, err
+	}
+
+	return migrationTransfer(conn, size, func(received int) (io.Reader, error) {
+		conn.Close()
+		var err error
+		if conn, err = tcpTuning.dial("tcp", addr); err != nil {
+			return nil, err
+		}
+		return conn, writeRpcRequest(conn, 0, size-received)
+	})
+}
+
+// Append a migration run to the migration file of the environment
+func reportMigration(protocol string, environment string, size int, result *migrationResult, err error) {
+	continued := err == nil
+	if err != nil {
+		fmt.Printf("[%s - %s] %s: did not survive the address change: %s\n", protocol, environment, getSizeString(size), err)
+		result = &migrationResult{}
+	} else {
+		fmt.Printf("[%s - %s] %s: stall: %s, before: %.0f kbps, after: %.0f kbps (%.0f%%), total: %s\n", protocol, environment, getSizeString(size), result.stall, result.rateBefore/1024.0, result.rateAfter/1024.0, 100*result.rateAfter/result.rateBefore, result.duration)
+	}
+
+	fileName := outputFile("migration", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%d,%t,", protocol, environment, size, continued))
+	f.WriteString(fmt.Sprintf("%d,%f,%f,", result.stall.Microseconds(), result.rateBefore, result.rateAfter))
+	f.WriteString(fmt.Sprintf("%d", result.duration.Microseconds()))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
+
+// Download size bytes filesToSend times over one mode, changing address halfway through each.
+func clientMigrationMain(environment string, host string, port int, mode string, size int) error {
+	if mode != migrationTcp && !builtinQuicOnly(mode+" migration") {
+		return nil
+	}
+	fmt.Printf("Testing %s connection migration...\n", mode)
+	protocolName := fmt.Sprintf("%s Migration", mode) // for report and logging strings
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	// Every run is reported, but a run that didn't survive fails the measurement.
+	var firstErr error
+	for i := 0; i < filesToSend; i++ {
+		var result *migrationResult
+		var err error
+		switch mode {
+		case migrationQuic, migrationQuicRelay:
+			result, err = quicMigration(addr, host, size, mode == migrationQuicRelay)
+		case migrationTcp:
+			result, err = tcpMigration(addr, size)
+		default:
+			return fmt.Errorf("unknown migration mode %q", mode)
+		}
+		reportMigration(protocolName, environment, size, result, err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Open-loop load issues requests on a fixed schedule, whether or not earlier
+// ones have completed. Latency is measured from when a request was meant to be
+// sent, not from when it went out, so a client that falls behind the schedule
+// (or a server that makes it) shows up in the numbers instead of silently
+// lowering the offered load (coordinated omission).
+const (
+	arrivalsConstant = "constant"
+	arrivalsPoisson  = "poisson"
+)
+
+// The outcome of an open-loop run.
+type openLoopResult struct {
+	sent        int           // requests issued
+	maxLag      time.Duration // largest delay between intended and actual send time
+	outstanding int           // most requests in flight at once
+	duration    time.Duration // of the schedule, until the last request was issued
+	drain       time.Duration // waiting for the requests still in flight after that
+	err         error         // of the first send that panicked
+}
+
+func validArrivals(arrivals string) error {
+	if arrivals != arrivalsConstant && arrivals != arrivalsPoisson {
+		return fmt.Errorf("invalid arrivals %q, expected %s or %s", arrivals, arrivalsConstant, arrivalsPoisson)
+	}
+	return nil
+}
+
+// Call send with its intended start time, rate times per second on average, for duration.
+func runOpenLoop(rate float64, arrivals string, duration time.Duration, send func(intended time.Time)) openLoopResult {
+	result := openLoopResult{}
+	mean := float64(time.Second) / rate
+
+	var mu sync.Mutex
+	inFlight := 0
+	var workers []<-chan error
+	loadStart := time.Now()
+	for next := loadStart; next.Sub(loadStart) < duration; {
+		time.Sleep(time.Until(next))
+		if lag := time.Since(next); lag > result.maxLag {
+			result.maxLag = lag
+		}
+
+		mu.Lock()
+		inFlight++
+		if inFlight > result.outstanding {
+			result.outstanding = inFlight
+		}
+		mu.Unlock()
+		result.sent++
+
+		intended := next
+		workers = append(workers, goWorker(func() error {
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			send(intended)
+			return nil
+		}))
+
+		// The schedule advances from the intended times, never from when a send actually happened.
+		if arrivals == arrivalsPoisson {
+			next = next.Add(time.Duration(rand.ExpFloat64() * mean))
+		} else {
+			next = next.Add(time.Duration(mean))
+		}
+	}
+	result.duration = time.Since(loadStart)
+	result.err = waitWorkers(workers)
+	result.drain = time.Since(loadStart) - result.duration
+	return result
+}
+
+// Print the achieved against the target rate of an open-loop run, and append them to the open-loop file of the environment
+func reportOpenLoop(protocol string, environment string, rate float64, arrivals string, completed int, failures int, result openLoopResult) {
+	sentRate := float64(result.sent) / result.duration.Seconds()
+	completedRate := float64(completed) / (result.duration + result.drain).Seconds()
+	fmt.Printf("[%s - %s] target: %.1f req/s (%s), sent: %.1f req/s, completed: %.1f req/s, failed: %d, max send lag: %s, max outstanding: %d, drain: %s\n", protocol, environment, rate, arrivals, sentRate, completedRate, failures, result.maxLag, result.outstanding, result.drain)
+
+	fileName := outputFile("openloop", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%s,%f,", protocol, environment, arrivals, rate))
+	f.WriteString(fmt.Sprintf("%f,%f,%d,", sentRate, completedRate, failures))
+	f.WriteString(fmt.Sprintf("%d,%d,%d", result.maxLag.Microseconds(), result.outstanding, result.drain.Microseconds()))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// A page is a root document plus the resources it pulls in. A resource is
+// requested once what it depends on has completed: its parent if it names one,
+// otherwise every resource of the previous dependency level. Resources are
+// served by GET /bytes/<size>, so any manifest replays against the echo server.
+type pageResource struct {
+	Path        string `json:"path"`
+	Size        int    `json:"size"`
+	Parent      string `json:"parent,omitempty"`      // path of the resource that references this one
+	Level       int    `json:"level,omitempty"`       // used when there is no parent, 0 is the root document
+	ContentType string `json:"contentType,omitempty"` // the server answers with this Content-Type
+	Priority    string `json:"priority,omitempty"`    // browser priority, sent as the request's urgency (see priorityHeader)
+}
+
+type pageManifest struct {
+	Name      string         `json:"name"`
+	Resources []pageResource `json:"resources"`
+}
+
+// When a resource was requested, got its response headers, and finished, relative to the start of the page load.
+type resourceTiming struct {
+	resource pageResource
+	start    time.Duration
+	headers  time.Duration
+	end      time.Duration
+	err      error
+}
+
+// Chrome's request priorities, highest first, as the urgencies of RFC 9218 it sends them with.
+var resourcePriorities = map[string]int{"VeryHigh": 0, "Highest": 0, "High": 1, "Medium": 2, "Low": 3, "Lowest": 4, "VeryLow": 4}
+
+func (r pageResource) priorityRank() int {
+	if rank, ok := resourcePriorities[r.Priority]; ok {
+		return rank
+	}
+	return resourcePriorities["Medium"]
+}
+
+// The Priority header of a resource's request (RFC 9218), the priority signal of
+// HTTP/2 and HTTP/3 browsers send, for the server to schedule responses by. Only
+// the server decides what goes first on a shared connection, so requests starting
+// in priority order alone wouldn't change what the page gets when. Go's servers,
+// ours included, don't schedule by it, some like h2o do.
+func (r pageResource) priorityHeader() string {
+	return fmt.Sprintf("u=%d", r.priorityRank())
+}
+
+// Browsers open at most this many HTTP/1.1 connections per host.
+const browserConnectionsPerHost = 6
+
+// A typical page when no manifest is given: markup, then styles and scripts, then what they reference.
+var defaultPageManifest = pageManifest{
+	Name: "default",
+	Resources: []pageResource{
+		{Path: "/index.html", Size: 51200},
+		{Path: "/css/main.css", Size: 81920, Parent: "/index.html"},
+		{Path: "/css/theme.css", Size: 20480, Parent: "/index.html"},
+		{Path: "/js/vendor.js", Size: 409600, Parent: "/index.html"},
+		{Path: "/js/app.js", Size: 153600, Parent: "/index.html"},
+		{Path: "/js/analytics.js", Size: 40960, Parent: "/index.html"},
+		{Path: "/img/hero.jpg", Size: 307200, Parent: "/index.html"},
+		{Path: "/img/logo.svg", Size: 8192, Parent: "/index.html"},
+		{Path: "/fonts/regular.woff2", Size: 61440, Parent: "/css/main.css"},
+		{Path: "/fonts/bold.woff2", Size: 63488, Parent: "/css/main.css"},
+		{Path: "/img/background.png", Size: 122880, Parent: "/css/theme.css"},
+		{Path: "/img/icons.png", Size: 16384, Parent: "/css/main.css"},
+		{Path: "/api/content.json", Size: 24576, Parent: "/js/app.js"},
+		{Path: "/img/thumb1.jpg", Size: 40960, Parent: "/api/content.json"},
+		{Path: "/img/thumb2.jpg", Size: 45056, Parent: "/api/content.json"},
+		{Path: "/img/thumb3.jpg", Size: 38912, Parent: "/api/content.json"},
+		{Path: "/img/thumb4.jpg", Size: 43008, Parent: "/api/content.json"},
+	},
+}
+
+// Read a page manifest from a JSON file, or return the default page for an empty path.
+func loadPageManifest(fileName string) (*pageManifest, error) {
+	if fileName == "" {
+		return &defaultPageManifest, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &pageManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if manifest.Name == "" {
+		manifest.Name = fileName
+	}
+	if _, err := manifest.prerequisites(); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	return manifest, nil
+}
+
+// The indices of the resources each resource waits for.
+func (m *pageManifest) prerequisites() ([][]int, error) {
+	if len(m.Resources) == 0 {
+		return nil, fmt.Errorf("page %q has no resources", m.Name)
+	}
+
+	index := make(map[string]int)
+	for i, resource := range m.Resources {
+		if resource.Size < 0 {
+			return nil, fmt.Errorf("%s has a negative size", resource.Path)
+		}
+		index[resource.Path] = i
+	}
+
+	prerequisites := make([][]int, len(m.Resources))
+	for i, resource := range m.Resources {
+		if resource.Parent != "" {
+			parent, ok := index[resource.Parent]
+			if !ok {
+				return nil, fmt.Errorf("%s references unknown parent %s", resource.Path, resource.Parent)
+			}
+			if parent >= i {
+				return nil, fmt.Errorf("%s must come after its parent %s", resource.Path, resource.Parent)
+			}
+			prerequisites[i] = []int{parent}
+		} else if resource.Level > 0 {
+			for j, other := range m.Resources {
+				if other.Parent == "" && other.Level == resource.Level-1 {
+					prerequisites[i] = append(prerequisites[i], j)
+				}
+			}
+			if len(prerequisites[i]) == 0 {
+				return nil, fmt.Errorf("%s is at level %d, but nothing is at level %d", resource.Path, resource.Level, resource.Level-1)
+			}
+		}
+	}
+	return prerequisites, nil
+}
+
+func (m *pageManifest) totalSize() int {
+	total := 0
+	for _, resource := range m.Resources {
+		total += resource.Size
+	}
+	return total
+}
+
+// Fetch one resource, timing it from loadStart.
+func fetchResource(client *http.Client, url string, resource pageResource, loadStart time.Time) resourceTiming {
+	timing := resourceTiming{resource: resource, start: time.Since(loadStart)}
+
+	resourceUrl := fmt.Sprintf("%sbytes/%d", url, resource.Size)
+	if resource.ContentType != "" {
+		resourceUrl += "?type=" + neturl.QueryEscape(resource.ContentType)
+	}
+	request, err := http.NewRequest(http.MethodGet, resourceUrl, nil)
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	request.Header.Set("Priority", resource.priorityHeader())
+	response, err := client.Do(request)
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	timing.headers = time.Since(loadStart)
+
+	received, err := io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	timing.end = time.Since(loadStart)
+	if err != nil {
+		timing.err = err
+	} else if response.StatusCode != http.StatusOK || int(received) != resource.Size {
+		timing.err = fmt.Errorf("%s: got %s with %d of %d bytes", resource.Path, response.Status, received, resource.Size)
+	}
+	return timing
+}
+
+// Load the page once, requesting every resource as soon as what it depends on is done.
+func loadPage(client *http.Client, url string, manifest *pageManifest, prerequisites [][]int) ([]resourceTiming, time.Duration, error) {
+	remaining := make([]int, len(manifest.Resources))
+	dependents := make([][]int, len(manifest.Resources))
+	for i, required := range prerequisites {
+		remaining[i] = len(required)
+		for _, j := range required {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	type fetched struct {
+		index  int
+		timing resourceTiming
+	}
+	done := make(chan fetched)
+	loadStart := time.Now()
+	inFlight := 0
+	request := func(i int) {
+		inFlight++
+		go func() {
+			timing := resourceTiming{resource: manifest.Resources[i]}
+			defer func() { done <- fetched{i, timing} }()
+			defer recoverError(&timing.err)
+			timing = fetchResource(client, url, manifest.Resources[i], loadStart)
+		}()
+	}
+
+	// Resources that become ready together are requested by priority, then in manifest order,
+	// though it's the Priority header of their requests that can change what's sent first.
+	requestAll := func(ready []int) {
+		sort.SliceStable(ready, func(a, b int) bool {
+			return manifest.Resources[ready[a]].priorityRank() < manifest.Resources[ready[b]].priorityRank()
+		})
+		for _, i := range ready {
+			request(i)
+		}
+	}
+
+	var ready []int
+	for i := range manifest.Resources {
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	requestAll(ready)
+
+	timings := make([]resourceTiming, len(manifest.Resources))
+	var err error
+	for inFlight > 0 {
+		result := <-done
+		inFlight--
+		timings[result.index] = result.timing
+		if result.timing.err != nil {
+			if err == nil {
+				err = result.timing.err
+			}
+			continue
+		}
+		if err != nil {
+			continue // let what's in flight finish, but start nothing new
+		}
+
+		ready = ready[:0]
+		for _, i := range dependents[result.index] {
+			remaining[i]--
+			if remaining[i] == 0 {
+				ready = append(ready, i)
+			}
+		}
+		requestAll(ready)
+	}
+
+	return timings, time.Since(loadStart), err
+}
+
+// Append the waterfall of a page load to the waterfall file of the environment
+func reportWaterfall(protocol string, environment string, page string, load int, timings []resourceTiming) {
+	fileName := outputFile("waterfall", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	for _, timing := range timings {
+		f.WriteString(fmt.Sprintf("%s,%s,%s,%d,%s,%s,%d,", protocol, environment, page, load, timing.resource.Path, timing.resource.Parent, timing.resource.Size))
+		f.WriteString(fmt.Sprintf("%d,%d,%d", timing.start.Microseconds(), timing.headers.Microseconds(), timing.end.Microseconds()))
+		f.WriteString(settingsColumns())
+		f.WriteString("\n")
+	}
+}
+
+// Load the page filesToSend times over one HTTP version, each time on new connections like a cold browser.
+func clientPageLoadMain(environment string, host string, port int, variant string, manifest *pageManifest) error {
+	fmt.Printf("Testing %s page load (%s)...\n", variant, manifest.Name)
+	protocolName := fmt.Sprintf("%s Page Load", variant) // for report and logging strings
+
+	prerequisites, err := manifest.prerequisites()
+	if err != nil {
+		return err
+	}
+
+	// A failed load doesn't stop the others, but fails the measurement.
+	var firstErr error
+	pageLoadTimes := make([]time.Duration, 0, filesToSend)
+	loadsStart := time.Now()
+	for load := 0; load < filesToSend; load++ {
+		transport, url, err := newWorkloadTransport(variant, host, port)
+		if err != nil {
+			return err
+		}
+		if httpTransport, ok := transport.(*http.Transport); ok {
+			httpTransport.MaxConnsPerHost = browserConnectionsPerHost
+			httpTransport.MaxIdleConnsPerHost = browserConnectionsPerHost
+		}
+		client := &http.Client{Transport: transport}
+
+		timings, pageLoadTime, err := loadPage(client, url, manifest, prerequisites)
+		client.CloseIdleConnections()
+		if closer, ok := transport.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			fmt.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if load == 0 {
+			for _, timing := range timings {
+				fmt.Printf("[%s - %s] %-24s %8s  start: %-12s headers: %-12s end: %s\n", protocolName, environment, timing.resource.Path, getSizeString(timing.resource.Size), timing.start, timing.headers, timing.end)
+			}
+		}
+		reportWaterfall(protocolName, environment, manifest.Name, load, timings)
+		pageLoadTimes = append(pageLoadTimes, pageLoadTime)
+	}
+
+	reportLatencies(protocolName, environment, "Page Load", manifest.totalSize(), pageLoadTimes, time.Since(loadsStart))
+	return firstErr
+}
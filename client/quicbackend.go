@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// The QUIC and HTTP/3 drivers reach their QUIC implementation through a
+// quicBackend, picked for a run with -quicBackend and recorded with every
+// result. Backends register themselves under a name from an init function; the
+// built-in one wraps lucas-clemente/quic-go. Others live in files of their own
+// behind a build tag, so the default binary doesn't carry them: building with
+// -tags quicgo adds quic-go/quic-go (see quicbackend_quicgo.go).
+//
+// Options are given as quicOptions already tuned by quicTuning, which every
+// backend translates into its own configuration. WebTransport and the
+// migration benchmark rely on what only quic-go v0.25 exposes (datagrams, raw
+// uni streams, its own sockets) and skip other backends.
+type quicBackend interface {
+	String() string // implementation and version, recorded with results
+	dial(addr string, tlsConf *tls.Config, options quicOptions) (quicSession, error)
+	http3Transport(tlsConf *tls.Config, options quicOptions) http.RoundTripper
+}
+
+// What a connection asks of its QUIC implementation, zero where left to the implementation.
+type quicOptions struct {
+	initialStreamWindow     uint64
+	maxStreamWindow         uint64
+	initialConnectionWindow uint64
+	maxConnectionWindow     uint64
+	idleTimeout             time.Duration
+	handshakeTimeout        time.Duration
+	maxIncomingStreams      int64
+	maxIncomingUniStreams   int64
+	keepAlive               bool
+	datagrams               bool
+
+	// Told of every connection an HTTP/3 transport opens, with a context done once it's closed.
+	connected func(ctx context.Context)
+}
+
+// What the drivers use of a QUIC connection.
+type quicSession interface {
+	OpenStreamSync(ctx context.Context) (quicStream, error)
+	CloseWithError(code uint64, reason string) error
+	Context() context.Context // done once the connection is closed
+}
+
+type quicStream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+const builtinQuicBackend = "quic-go"
+
+var quicBackends = make(map[string]quicBackend)
+
+// The backend of the run.
+var quicImplementation quicBackend
+
+// The server's QUIC implementation as it reported it, recorded with results.
+var serverQuicImplementation = "unknown"
+
+func registerQuicBackend(name string, backend quicBackend) {
+	if _, ok := quicBackends[name]; ok {
+		panic(fmt.Sprintf("QUIC backend %q registered twice", name))
+	}
+	quicBackends[name] = backend
+}
+
+func selectQuicBackend(name string) error {
+	backend, ok := quicBackends[name]
+	if !ok {
+		var names []string
+		for registered := range quicBackends {
+			names = append(names, registered)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown QUIC backend %q, expected one of %v", name, names)
+	}
+	quicImplementation = backend
+	return nil
+}
+
+// Whether a driver that needs quic-go v0.25 itself can run, saying why not if it can't.
+func builtinQuicOnly(driver string) bool {
+	if quicImplementation == quicBackends[builtinQuicBackend] {
+		return true
+	}
+	fmt.Printf("Skipping %s, which needs %s, not %s\n", driver, quicBackends[builtinQuicBackend], quicImplementation)
+	return false
+}
+
+// The path and version of a module the binary was built with, as path@version.
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				return dep.Path + "@" + dep.Version
+			}
+		}
+	}
+	return path
+}
+
+// legacyQuicBackend is lucas-clemente/quic-go, on sockets set up by udpTuning.
+type legacyQuicBackend struct {
+	version string
+}
+
+type legacyQuicSession struct {
+	quic.Session
+}
+
+func init() {
+	registerQuicBackend(builtinQuicBackend, &legacyQuicBackend{version: moduleVersion("github.com/lucas-clemente/quic-go")})
+	quicImplementation = quicBackends[builtinQuicBackend]
+}
+
+func (b *legacyQuicBackend) String() string {
+	return b.version
+}
+
+// The quic-go v0.25 Config of options, also used by the drivers that only run on it.
+func legacyQuicConfig(options quicOptions) *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow:     options.initialStreamWindow,
+		MaxStreamReceiveWindow:         options.maxStreamWindow,
+		InitialConnectionReceiveWindow: options.initialConnectionWindow,
+		MaxConnectionReceiveWindow:     options.maxConnectionWindow,
+		MaxIdleTimeout:                 options.idleTimeout,
+		HandshakeIdleTimeout:           options.handshakeTimeout,
+		MaxIncomingStreams:             options.maxIncomingStreams,
+		MaxIncomingUniStreams:          options.maxIncomingUniStreams,
+		KeepAlive:                      options.keepAlive,
+		EnableDatagrams:                options.datagrams,
+	}
+}
+
+func (b *legacyQuicBackend) dial(addr string, tlsConf *tls.Config, options quicOptions) (quicSession, error) {
+	session, err := udpTuning.dial(addr, tlsConf, legacyQuicConfig(options))
+	if err != nil {
+		return nil, err
+	}
+	return &legacyQuicSession{Session: session}, nil
+}
+
+func (b *legacyQuicBackend) http3Transport(tlsConf *tls.Config, options quicOptions) http.RoundTripper {
+	dial := func(network string, addr string, tlsConf *tls.Config, config *quic.Config) (quic.EarlySession, error) {
+		session, err := udpTuning.dialEarly(network, addr, tlsConf, config)
+		if err == nil && options.connected != nil {
+			options.connected(session.Context())
+		}
+		return session, err
+	}
+	return &http3.RoundTripper{TLSClientConfig: tlsConf, Dial: dial, QuicConfig: legacyQuicConfig(options)}
+}
+
+func (s *legacyQuicSession) OpenStreamSync(ctx context.Context) (quicStream, error) {
+	stream, err := s.Session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *legacyQuicSession) CloseWithError(code uint64, reason string) error {
+	return s.Session.CloseWithError(quic.ApplicationErrorCode(code), reason)
+}
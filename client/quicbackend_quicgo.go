@@ -0,0 +1,130 @@
+//go:build quicgo
+// +build quicgo
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+	quicgohttp3 "github.com/quic-go/quic-go/http3"
+)
+
+// quic-go/quic-go is where quic-go lives since it left lucas-clemente, v0.32
+// being the last release that still builds with the Go of our images. Built
+// with -tags quicgo, -quicBackend quic-go/quic-go runs the QUIC and HTTP/3
+// tests on it, over the same tuned sockets as the built-in backend.
+const quicGoBackend = "quic-go/quic-go"
+
+// quic-go v0.25 keeps connections alive every half of their idle timeout;
+// quic-go/quic-go does so every KeepAlivePeriod, but never less often than that.
+const quicGoKeepAlivePeriod = time.Hour
+
+type quicGoBackendImpl struct {
+	version string
+}
+
+type quicGoSession struct {
+	quicgo.Connection
+}
+
+func init() {
+	registerQuicBackend(quicGoBackend, &quicGoBackendImpl{version: moduleVersion("github.com/quic-go/quic-go")})
+}
+
+func (b *quicGoBackendImpl) String() string {
+	return b.version
+}
+
+func quicGoConfig(options quicOptions) *quicgo.Config {
+	config := &quicgo.Config{
+		InitialStreamReceiveWindow:     options.initialStreamWindow,
+		MaxStreamReceiveWindow:         options.maxStreamWindow,
+		InitialConnectionReceiveWindow: options.initialConnectionWindow,
+		MaxConnectionReceiveWindow:     options.maxConnectionWindow,
+		MaxIdleTimeout:                 options.idleTimeout,
+		HandshakeIdleTimeout:           options.handshakeTimeout,
+		MaxIncomingStreams:             options.maxIncomingStreams,
+		MaxIncomingUniStreams:          options.maxIncomingUniStreams,
+		EnableDatagrams:                options.datagrams,
+	}
+	if options.keepAlive {
+		config.KeepAlivePeriod = quicGoKeepAlivePeriod
+	}
+	return config
+}
+
+// Dial like udpTuning.dial, on a socket it sets up, closed with the connection.
+func quicGoDial(addr string, tlsConf *tls.Config, config *quicgo.Config) (quicgo.Connection, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := udpTuning.listenUdp(":0")
+	if err != nil {
+		return nil, err
+	}
+	session, err := quicgo.Dial(udpTuning.wrap(conn), remote, addr, tlsConf, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	udpTuning.inspect(conn)
+	go closeWithSession(session.Context(), conn)
+	return session, nil
+}
+
+// Dial like udpTuning.dialEarly, for the HTTP/3 round tripper.
+func quicGoDialEarly(ctx context.Context, addr string, tlsConf *tls.Config, config *quicgo.Config) (quicgo.EarlyConnection, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := udpTuning.listenUdp(":0")
+	if err != nil {
+		return nil, err
+	}
+	session, err := quicgo.DialEarlyContext(ctx, udpTuning.wrap(conn), remote, addr, tlsConf, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	udpTuning.inspect(conn)
+	go closeWithSession(session.Context(), conn)
+	return session, nil
+}
+
+func (b *quicGoBackendImpl) dial(addr string, tlsConf *tls.Config, options quicOptions) (quicSession, error) {
+	session, err := quicGoDial(addr, tlsConf, quicGoConfig(options))
+	if err != nil {
+		return nil, err
+	}
+	return &quicGoSession{Connection: session}, nil
+}
+
+func (b *quicGoBackendImpl) http3Transport(tlsConf *tls.Config, options quicOptions) http.RoundTripper {
+	dial := func(ctx context.Context, addr string, tlsConf *tls.Config, config *quicgo.Config) (quicgo.EarlyConnection, error) {
+		session, err := quicGoDialEarly(ctx, addr, tlsConf, config)
+		if err == nil && options.connected != nil {
+			options.connected(session.Context())
+		}
+		return session, err
+	}
+	return &quicgohttp3.RoundTripper{TLSClientConfig: tlsConf, Dial: dial, QuicConfig: quicGoConfig(options)}
+}
+
+func (s *quicGoSession) OpenStreamSync(ctx context.Context) (quicStream, error) {
+	stream, err := s.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *quicGoSession) CloseWithError(code uint64, reason string) error {
+	return s.Connection.CloseWithError(quicgo.ApplicationErrorCode(code), reason)
+}
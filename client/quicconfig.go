@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The quic-go knobs an experiment can turn. Each is a -quic<Knob> flag taking a
+// comma separated list of values, or an entry of the scenario file given to
+// -quicScenario, which maps knob names to lists of values. The client runs its
+// tests once for every combination (see quicSweep), and records the one in use
+// with every result, next to the server's (see server/quicconfig.go).
+var quicKnobs = []struct {
+	name        string
+	description string
+}{
+	{"initialStreamWindow", "Initial stream receive window, in bytes"},
+	{"maxStreamWindow", "Maximum stream receive window, in bytes"},
+	{"initialConnectionWindow", "Initial connection receive window, in bytes"},
+	{"maxConnectionWindow", "Maximum connection receive window, in bytes"},
+	{"idleTimeout", "Idle timeout of sessions, as a duration (30s)"},
+	{"handshakeTimeout", "Idle timeout of handshakes, as a duration (5s)"},
+	{"maxIncomingStreams", "Bidirectional streams the peer may open"},
+	{"maxIncomingUniStreams", "Unidirectional streams the peer may open"},
+	{"keepAlive", "Send keepalives (true or false)"},
+}
+
+// Settings of quic-go, zero where left to quic-go or to what a test asks for.
+type quicSettings struct {
+	initialStreamWindow     uint64
+	maxStreamWindow         uint64
+	initialConnectionWindow uint64
+	maxConnectionWindow     uint64
+	idleTimeout             time.Duration
+	handshakeTimeout        time.Duration
+	maxIncomingStreams      int64
+	maxIncomingUniStreams   int64
+	keepAlive               *bool
+
+	labels []string // name=value of every knob set, in the order of quicKnobs
+}
+
+// The settings every QUIC connection of the client uses, changed between sweep points.
+var quicTuning = &quicSettings{}
+
+// The server's settings as it reported them, recorded with results.
+var serverQuicTuning = "unknown"
+
+func (s *quicSettings) set(name string, value string) error {
+	var err error
+	switch name {
+	case "initialStreamWindow":
+		s.initialStreamWindow, err = strconv.ParseUint(value, 10, 64)
+	case "maxStreamWindow":
+		s.maxStreamWindow, err = strconv.ParseUint(value, 10, 64)
+	case "initialConnectionWindow":
+		s.initialConnectionWindow, err = strconv.ParseUint(value, 10, 64)
+	case "maxConnectionWindow":
+		s.maxConnectionWindow, err = strconv.ParseUint(value, 10, 64)
+	case "idleTimeout":
+		s.idleTimeout, err = time.ParseDuration(value)
+	case "handshakeTimeout":
+		s.handshakeTimeout, err = time.ParseDuration(value)
+	case "maxIncomingStreams":
+		s.maxIncomingStreams, err = strconv.ParseInt(value, 10, 64)
+	case "maxIncomingUniStreams":
+		s.maxIncomingUniStreams, err = strconv.ParseInt(value, 10, 64)
+	case "keepAlive":
+		var keepAlive bool
+		keepAlive, err = strconv.ParseBool(value)
+		s.keepAlive = &keepAlive
+	default:
+		return fmt.Errorf("unknown QUIC knob %q", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for QUIC knob %s", value, name)
+	}
+	s.labels = append(s.labels, name+"="+value)
+	return nil
+}
+
+// Apply the settings over base, which holds what the caller needs when nothing is set.
+func (s *quicSettings) options(base quicOptions) quicOptions {
+	options := base
+	if s.initialStreamWindow > 0 {
+		options.initialStreamWindow = s.initialStreamWindow
+	}
+	if s.maxStreamWindow > 0 {
+		options.maxStreamWindow = s.maxStreamWindow
+	}
+	if s.initialConnectionWindow > 0 {
+		options.initialConnectionWindow = s.initialConnectionWindow
+	}
+	if s.maxConnectionWindow > 0 {
+		options.maxConnectionWindow = s.maxConnectionWindow
+	}
+	if s.idleTimeout > 0 {
+		options.idleTimeout = s.idleTimeout
+	}
+	if s.handshakeTimeout > 0 {
+		options.handshakeTimeout = s.handshakeTimeout
+	}
+	if s.maxIncomingStreams != 0 {
+		options.maxIncomingStreams = s.maxIncomingStreams
+	}
+	if s.maxIncomingUniStreams != 0 {
+		options.maxIncomingUniStreams = s.maxIncomingUniStreams
+	}
+	if s.keepAlive != nil {
+		options.keepAlive = *s.keepAlive
+	}
+	return options
+}
+
+// The knobs set, space separated so it fits in a CSV column, or "default".
+func (s *quicSettings) String() string {
+	if len(s.labels) == 0 {
+		return "default"
+	}
+	return strings.Join(s.labels, " ")
+}
+
+// Register a -quic<Knob> flag for every knob.
+func quicFlags() map[string]*string {
+	flags := make(map[string]*string)
+	for _, knob := range quicKnobs {
+		flagName := "quic" + strings.ToUpper(knob.name[:1]) + knob.name[1:]
+		flags[knob.name] = flag.String(flagName, "", knob.description+", comma separated values to sweep")
+	}
+	return flags
+}
+
+// Every combination of the knob values given by flags and the scenario file (which wins), in the order of quicKnobs.
+func quicSweep(flags map[string]*string, scenarioFile string) ([]*quicSettings, error) {
+	values := make(map[string][]string)
+	for name, value := range flags {
+		if *value != "" {
+			values[name] = strings.Split(*value, ",")
+		}
+	}
+
+	if scenarioFile != "" {
+		data, err := ioutil.ReadFile(scenarioFile)
+		if err != nil {
+			return nil, err
+		}
+		scenario := make(map[string][]string)
+		if err := json.Unmarshal(data, &scenario); err != nil {
+			return nil, fmt.Errorf("%s: %s", scenarioFile, err)
+		}
+		for name, list := range scenario {
+			if len(list) == 0 {
+				return nil, fmt.Errorf("%s: no values for %s", scenarioFile, name)
+			}
+			values[name] = list
+		}
+	}
+
+	sweep := []*quicSettings{{}}
+	for _, knob := range quicKnobs {
+		list, ok := values[knob.name]
+		if !ok {
+			continue
+		}
+		delete(values, knob.name)
+
+		var next []*quicSettings
+		for _, settings := range sweep {
+			for _, value := range list {
+				combined := *settings
+				combined.labels = append([]string{}, settings.labels...)
+				if err := combined.set(knob.name, strings.TrimSpace(value)); err != nil {
+					return nil, err
+				}
+				next = append(next, &combined)
+			}
+		}
+		sweep = next
+	}
+	for name := range values {
+		return nil, fmt.Errorf("unknown QUIC knob %q", name)
+	}
+	return sweep, nil
+}
+
+// The QUIC, TCP, buffer and UDP settings of the client and the server, then their QUIC
+// implementations and the HTTP server of interop runs, as the last columns of a result row.
+// The UDP settings are followed by what the kernel applied, and the row ends with the
+// measurement that wrote it (see checkpoint.go).
+func settingsColumns() string {
+	columns := fmt.Sprintf(",%s,%s,%s,%s,%d,%s", quicTuning, serverQuicTuning, tcpTuning, serverTcpTuning, writeChunkSize, serverBufferTuning)
+	columns += fmt.Sprintf(",%s,%s,%s,%s", udpTuning, udpTuning.applied(), serverUdpTuning, serverUdpEffective)
+	return columns + fmt.Sprintf(",%s,%s,%s,%s", quicImplementation, serverQuicImplementation, interopServer, measurementColumn)
+}
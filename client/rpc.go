@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RPCs draw request and response sizes from a distribution, and run either
+// closed-loop (a fixed number of callers, each waiting for its answer) or
+// open-loop (requests sent on a schedule whatever the answers do, see
+// openloop.go). Over the raw transports an RPC starts with the two sizes, see
+// server/rpc.go.
+const (
+	rpcTcp    = "TCP"
+	rpcTcpTls = "TCP_TLS"
+	rpcQuic   = "QUIC"
+)
+
+const rpcHeaderSize = 8
+
+type sizeDistribution interface {
+	sample() int
+	String() string
+}
+
+type fixedSize int
+
+type uniformSize struct {
+	min int
+	max int
+}
+
+type exponentialSize struct {
+	mean float64
+}
+
+// empiricalSize interpolates between the points of a cumulative distribution.
+type empiricalSize struct {
+	name  string
+	sizes []float64
+	cdf   []float64
+}
+
+func (d fixedSize) sample() int {
+	return int(d)
+}
+
+func (d fixedSize) String() string {
+	return fmt.Sprintf("fixed:%d", int(d))
+}
+
+func (d uniformSize) sample() int {
+	return d.min + rand.Intn(d.max-d.min+1)
+}
+
+func (d uniformSize) String() string {
+	return fmt.Sprintf("uniform:%d-%d", d.min, d.max)
+}
+
+func (d exponentialSize) sample() int {
+	return min(int(rand.ExpFloat64()*d.mean), finalMessageSize)
+}
+
+func (d exponentialSize) String() string {
+	return fmt.Sprintf("exp:%.0f", d.mean)
+}
+
+func (d *empiricalSize) sample() int {
+	u := rand.Float64()
+	i := sort.SearchFloat64s(d.cdf, u)
+	if i == 0 {
+		return int(d.sizes[0])
+	}
+	if i == len(d.cdf) {
+		return int(d.sizes[len(d.sizes)-1])
+	}
+	fraction := (u - d.cdf[i-1]) / (d.cdf[i] - d.cdf[i-1])
+	return int(d.sizes[i-1] + fraction*(d.sizes[i]-d.sizes[i-1]))
+}
+
+func (d *empiricalSize) String() string {
+	return "cdf:" + d.name
+}
+
+// Read a CDF file: one "<size> <cumulative probability>" pair per line, both increasing, ending at 1.
+func loadEmpiricalSize(fileName string) (*empiricalSize, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &empiricalSize{name: fileName}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a size and a probability", fileName, line)
+		}
+		size, err1 := strconv.ParseFloat(fields[0], 64)
+		probability, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 != nil || err2 != nil || size < 0 || size > finalMessageSize || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("%s:%d: invalid point %q", fileName, line, scanner.Text())
+		}
+		if n := len(d.cdf); n > 0 && (size < d.sizes[n-1] || probability < d.cdf[n-1]) {
+			return nil, fmt.Errorf("%s:%d: sizes and probabilities must not decrease", fileName, line)
+		}
+		d.sizes = append(d.sizes, size)
+		d.cdf = append(d.cdf, probability)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(d.cdf) == 0 || d.cdf[len(d.cdf)-1] != 1 {
+		return nil, fmt.Errorf("%s: the distribution must end at probability 1", fileName)
+	}
+	return d, nil
+}
+
+// Parse fixed:<n>, uniform:<min>-<max>, exp:<mean> or cdf:<file>.
+func parseSizeDistribution(spec string) (sizeDistribution, error) {
+	kind, value := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, value = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "fixed":
+		size, err := strconv.Atoi(value)
+		if err == nil && size >= 0 && size <= finalMessageSize {
+			return fixedSize(size), nil
+		}
+	case "uniform":
+		bounds := strings.SplitN(value, "-", 2)
+		if len(bounds) == 2 {
+			low, err1 := strconv.Atoi(bounds[0])
+			high, err2 := strconv.Atoi(bounds[1])
+			if err1 == nil && err2 == nil && low >= 0 && low <= high && high <= finalMessageSize {
+				return uniformSize{low, high}, nil
+			}
+		}
+	case "exp":
+		mean, err := strconv.ParseFloat(value, 64)
+		if err == nil && mean > 0 && !math.IsInf(mean, 0) {
+			return exponentialSize{mean}, nil
+		}
+	case "cdf":
+		return loadEmpiricalSize(value)
+	}
+	return nil, fmt.Errorf("invalid size distribution %q, expected fixed:<n>, uniform:<min>-<max>, exp:<mean> or cdf:<file>", spec)
+}
+
+type rpcConfig struct {
+	requestSizes  sizeDistribution
+	responseSizes sizeDistribution
+	rate          float64 // requests per second when open-loop, 0 for closed-loop
+	arrivals      string  // constant or poisson spacing of open-loop requests
+	concurrency   int     // callers when closed-loop
+	duration      time.Duration
+}
+
+func (c *rpcConfig) String() string {
+	load := fmt.Sprintf("closed-%d", c.concurrency)
+	if c.rate > 0 {
+		load = fmt.Sprintf("open-%g/s-%s", c.rate, c.arrivals)
+	}
+	return fmt.Sprintf("%s/%s %s", c.requestSizes, c.responseSizes, load)
+}
+
+// rpcCaller runs RPCs over one protocol, and is safe for concurrent use.
+type rpcCaller interface {
+	call(requestSize int, responseSize int) error
+	Close() error
+}
+
+// tcpRpcCaller keeps a pool of connections, each carrying one RPC at a time.
+type tcpRpcCaller struct {
+	addr    string
+	tlsConf *tls.Config // nil for plain TCP
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+type quicRpcCaller struct {
+	session quicSession
+}
+
+type httpRpcCaller struct {
+	client *http.Client
+	url    string
+}
+
+func rpcHeader(requestSize int, responseSize int) []byte {
+	header := make([]byte, rpcHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(requestSize))
+	binary.BigEndian.PutUint32(header[4:8], uint32(responseSize))
+	return header
+}
+
+func writeRpcRequest(stream io.Writer, requestSize int, responseSize int) error {
+	if _, err := stream.Write(rpcHeader(requestSize, responseSize)); err != nil {
+		return err
+	}
+	_, err := stream.Write(dataBuffer[:requestSize])
+	return err
+}
+
+func (c *tcpRpcCaller) call(requestSize int, responseSize int) error {
+	c.mu.Lock()
+	var conn net.Conn
+	if n := len(c.idle); n > 0 {
+		conn = c.idle[n-1]
+		c.idle = c.idle[:n-1]
+	}
+	c.mu.Unlock()
+
+	if conn == nil {
+		var err error
+		if c.tlsConf != nil {
+			conn, err = tcpTuning.dialTls("tcp", c.addr, c.tlsConf)
+		} else {
+			conn, err = tcpTuning.dial("tcp", c.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeRpcRequest(conn, requestSize, responseSize)
+	if err == nil {
+		_, err = io.CopyN(ioutil.Discard, conn, int64(responseSize))
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.idle = append(c.idle, conn)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *tcpRpcCaller) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *quicRpcCaller) call(requestSize int, responseSize int) error {
+	stream, err := c.session.OpenStreamSync(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := writeRpcRequest(stream, requestSize, responseSize); err != nil {
+		return err
+	}
+	stream.Close()
+	_, err = io.CopyN(ioutil.Discard, stream, int64(responseSize))
+	return err
+}
+
+func (c *quicRpcCaller) Close() error {
+	return c.session.CloseWithError(0, "")
+}
+
+func (c *httpRpcCaller) call(requestSize int, responseSize int) error {
+	response, err := c.client.Post(fmt.Sprintf("%srpc?response=%d", c.url, responseSize), "application/octet-stream", bytes.NewReader(dataBuffer[:requestSize]))
+	if err != nil {
+		return err
+	}
+	return readHttpBody(response, responseSize)
+}
+
+func (c *httpRpcCaller) Close() error {
+	c.client.CloseIdleConnections()
+	if closer, ok := c.client.Transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Connect to the RPC server of protocol, one of the raw transports or an HTTP variant.
+func newRpcCaller(protocol string, host string, port int) (rpcCaller, error) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+
+	switch protocol {
+	case rpcTcp:
+		return &tcpRpcCaller{addr: addr}, nil
+	case rpcTcpTls:
+		return &tcpRpcCaller{addr: addr, tlsConf: tlsConf}, nil
+	case rpcQuic:
+		session, err := quicImplementation.dial(addr, tlsConf, quicTuning.options(quicOptions{maxIncomingStreams: 10000}))
+		if err != nil {
+			return nil, err
+		}
+		return &quicRpcCaller{session: session}, nil
+	}
+
+	transport, url, err := newWorkloadTransport(protocol, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if httpTransport, ok := transport.(*http.Transport); ok {
+		httpTransport.MaxIdleConnsPerHost = 1024 // keep a connection per concurrent call
+	}
+	return &httpRpcCaller{client: &http.Client{Transport: transport}, url: url}, nil
+}
+
+// The outcome of an RPC run. When open-loop, latencies count from the intended
+// send time and serviceTimes from the actual one.
+type rpcResult struct {
+	latencies    []time.Duration
+	serviceTimes []time.Duration
+	transferred  int64
+	failures     int
+	firstErr     error
+	openLoop     openLoopResult
+	duration     time.Duration
+}
+
+// Run RPCs for the configured duration, recording the latency of every successful one.
+func runRpcLoad(caller rpcCaller, config *rpcConfig) *rpcResult {
+	var mu sync.Mutex
+	result := &rpcResult{}
+
+	run := func(intended time.Time) {
+		requestSize := min(config.requestSizes.sample(), finalMessageSize)
+		responseSize := min(config.responseSizes.sample(), finalMessageSize)
+
+		start := time.Now()
+		err := caller.call(requestSize, responseSize)
+		end := time.Now()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			result.failures++
+			if result.firstErr == nil {
+				result.firstErr = err
+			}
+			return
+		}
+		result.latencies = append(result.latencies, end.Sub(intended))
+		result.serviceTimes = append(result.serviceTimes, end.Sub(start))
+		result.transferred += int64(requestSize + responseSize)
+	}
+
+	loadStart := time.Now()
+	if config.rate > 0 {
+		result.openLoop = runOpenLoop(config.rate, config.arrivals, config.duration, run)
+		if result.openLoop.err != nil {
+			result.failures++
+			if result.firstErr == nil {
+				result.firstErr = result.openLoop.err
+			}
+		}
+	} else {
+		var workers []<-chan error
+		for i := 0; i < config.concurrency; i++ {
+			workers = append(workers, goWorker(func() error {
+				for time.Since(loadStart) < config.duration {
+					run(time.Now())
+				}
+				return nil
+			}))
+		}
+		if err := waitWorkers(workers); err != nil {
+			result.failures++
+			if result.firstErr == nil {
+				result.firstErr = err
+			}
+		}
+	}
+	result.duration = time.Since(loadStart)
+
+	return result
+}
+
+// Run the RPC workload over one protocol and report its latency distribution and throughput.
+func clientRpcMain(environment string, host string, port int, protocol string, config *rpcConfig) error {
+	fmt.Printf("Testing %s RPC (%s)...\n", protocol, config)
+	protocolName := fmt.Sprintf("%s RPC %s", protocol, config) // for report and logging strings
+
+	caller, err := newRpcCaller(protocol, host, port)
+	if err != nil {
+		return err
+	}
+	defer caller.Close()
+
+	result := runRpcLoad(caller, config)
+	if result.firstErr != nil {
+		fmt.Printf("[%s - %s] %d RPCs failed, first error: %s\n", protocolName, environment, result.failures, result.firstErr)
+	}
+	if config.rate > 0 {
+		reportOpenLoop(protocolName, environment, config.rate, config.arrivals, len(result.latencies), result.failures, result.openLoop)
+	}
+	if len(result.latencies) == 0 {
+		// Failures under load are part of the results, but none succeeding fails the measurement.
+		return result.firstErr
+	}
+
+	goodput := float64(result.transferred) / result.duration.Seconds()
+	averageSize := int(result.transferred / int64(len(result.latencies)))
+	fmt.Printf("[%s - %s] %d RPCs, %d failed, goodput: %.0f kbps\n", protocolName, environment, len(result.latencies), result.failures, goodput/1024.0)
+	reportLatencies(protocolName, environment, "RPC", averageSize, result.latencies, result.duration)
+	if config.rate > 0 {
+		// Without the time spent waiting to be sent, for comparison with the corrected latencies above
+		reportLatencies(protocolName, environment, "RPC Service", averageSize, result.serviceTimes, result.duration)
+	}
+	return nil
+}
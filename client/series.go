@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -transferSample every flood records how many bytes it had moved every
+// interval, not only how long it took, so slow start, stalls and recoveries
+// show in series_<env>.csv. Raw, WebSocket, WebTransport (bidirectional and
+// datagram), gRPC bidirectional and pipelined HTTP/1.1 floods count what the
+// server acknowledged; HTTP uploads, WebTransport unidirectional streams and
+// gRPC calls streaming to the server, which only get a length back at the end,
+// count the bytes the transport has taken, which is what it was able to send
+// given flow control; gRPC calls streaming from the server count what came back.
+const (
+	measureAcknowledged = "acknowledged"
+	measureSent         = "sent"
+	measureReceived     = "received"
+)
+
+var transferSample time.Duration // 0 for none
+
+// Samples of one transfer, taken by a ticker while it runs.
+type transferSampler struct {
+	protocol    string
+	environment string
+	measure     string
+	size        int
+	start       time.Time
+
+	bytes   int64 // so far, updated atomically
+	samples []transferPoint
+	stop    chan bool
+	done    <-chan error
+}
+
+type transferPoint struct {
+	at    time.Duration // since the start
+	bytes int64
+}
+
+// Start sampling a transfer, nil if transfers aren't sampled.
+func startSampler(protocol string, environment string, measure string, size int) *transferSampler {
+	if transferSample <= 0 {
+		return nil
+	}
+	s := &transferSampler{
+		protocol:    protocol,
+		environment: environment,
+		measure:     measure,
+		size:        size,
+		start:       time.Now(),
+		stop:        make(chan bool),
+	}
+	s.done = goWorker(func() error {
+		ticker := time.NewTicker(transferSample)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.samples = append(s.samples, transferPoint{at: now.Sub(s.start), bytes: atomic.LoadInt64(&s.bytes)})
+			case <-s.stop:
+				return nil
+			}
+		}
+	})
+	return s
+}
+
+func (s *transferSampler) add(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.bytes, int64(n))
+	}
+}
+
+// Stop sampling, reporting the samples with a last one at the end if the transfer completed.
+func (s *transferSampler) finish(completed bool) {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	if err := <-s.done; err != nil {
+		fmt.Printf("[%s - %s] sampling failed: %s\n", s.protocol, s.environment, err)
+		return
+	}
+	if completed {
+		s.samples = append(s.samples, transferPoint{at: time.Since(s.start), bytes: atomic.LoadInt64(&s.bytes)})
+		reportSeries(s)
+	}
+}
+
+// A request body counting what the transport reads of it.
+type sampledBody struct {
+	io.ReadCloser
+	sampler *transferSampler
+}
+
+func (b *sampledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sampler.add(n)
+	return n, err
+}
+
+// Concurrent floods sample at once, and each one's rows go in together.
+var seriesMu sync.Mutex
+
+// Append the samples of a transfer to the series file of the environment
+func reportSeries(s *transferSampler) {
+	var rows strings.Builder
+	var previous transferPoint
+	for _, point := range s.samples {
+		rate := 0.0
+		if elapsed := point.at - previous.at; elapsed > 0 {
+			rate = float64(point.bytes-previous.bytes) * 8 / 1000 / elapsed.Seconds()
+		}
+		rows.WriteString(fmt.Sprintf("%s,%s,%s,%d,%d,", s.protocol, s.environment, s.measure, s.size, s.start.UnixNano()/1000))
+		rows.WriteString(fmt.Sprintf("%d,%d,%f", point.at.Microseconds(), point.bytes, rate))
+		rows.WriteString(settingsColumns())
+		rows.WriteString("\n")
+		previous = point
+	}
+
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+
+	fileName := outputFile("series", s.environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(rows.String())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource usage of a process: the server's comes from its /stats endpoint
+// (see server/stats.go), the client's from localStats.
+type processStats struct {
+	CpuMicros          int64  `json:"cpuMicros"`
+	Goroutines         int    `json:"goroutines"`
+	HeapBytes          uint64 `json:"heapBytes"`
+	RssBytes           uint64 `json:"rssBytes"`
+	Quic               string `json:"quic"`
+	Tcp                string `json:"tcp"`
+	Buffers            string `json:"buffers"`
+	Udp                string `json:"udp"`
+	UdpEffective       string `json:"udpEffective"`
+	QuicImplementation string `json:"quicImplementation"`
+}
+
+func (s *processStats) cpuTime() time.Duration {
+	return time.Duration(s.CpuMicros) * time.Microsecond
+}
+
+// Read the server's stats from its HTTP port, collecting its garbage first if gc.
+func fetchServerStats(host string, httpPort int, gc bool) (*processStats, error) {
+	if httpPort <= 0 {
+		return nil, fmt.Errorf("no HTTP port to read server stats from")
+	}
+	url := fmt.Sprintf("http://%s:%d/stats", host, httpPort)
+	if gc {
+		url += "?gc=1"
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server stats: server answered %s", response.Status)
+	}
+	stats := &processStats{}
+	if err := json.NewDecoder(response.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Goroutines and memory of the client, after a collection. CPU time isn't filled in.
+func localStats() *processStats {
+	runtime.GC()
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	stats := &processStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  memory.HeapAlloc,
+	}
+	// Resident pages are the second field of statm
+	if statm, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				stats.RssBytes = pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket options of every TCP connection the client opens, set once per run
+// by the -tcp* flags and recorded with every result next to the server's (see
+// server/tcpconfig.go). Zero values leave the kernel's defaults, except for
+// TCP_NODELAY which Go turns on unless told otherwise.
+type tcpSettings struct {
+	noDelay       bool
+	sendBuffer    int    // SO_SNDBUF, in bytes
+	receiveBuffer int    // SO_RCVBUF, in bytes
+	congestion    string // TCP_CONGESTION, e.g. cubic, bbr or reno
+	fastOpen      bool   // TCP_FASTOPEN_CONNECT, data goes out with the SYN when the server allows it
+}
+
+var tcpTuning = &tcpSettings{noDelay: true}
+
+// The server's settings as it reported them, recorded with results.
+var serverTcpTuning = "unknown"
+
+// The settings that differ from the defaults, space separated so they fit in a CSV column, or "default".
+func (s *tcpSettings) String() string {
+	var labels []string
+	if !s.noDelay {
+		labels = append(labels, "noDelay=false")
+	}
+	if s.sendBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("sendBuffer=%d", s.sendBuffer))
+	}
+	if s.receiveBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("receiveBuffer=%d", s.receiveBuffer))
+	}
+	if s.congestion != "" {
+		labels = append(labels, "congestion="+s.congestion)
+	}
+	if s.fastOpen {
+		labels = append(labels, "fastOpen=true")
+	}
+	if len(labels) == 0 {
+		return "default"
+	}
+	return strings.Join(labels, " ")
+}
+
+// Set the options that must be in place before connecting, failing the dial if the kernel refuses one.
+func (s *tcpSettings) control(network string, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if s.sendBuffer > 0 && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, s.sendBuffer)
+		}
+		if s.receiveBuffer > 0 && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, s.receiveBuffer)
+		}
+		if s.congestion != "" && err == nil {
+			err = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, s.congestion)
+		}
+		if s.fastOpen && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("TCP settings %s: %s", s, err)
+	}
+	return nil
+}
+
+func (s *tcpSettings) dialer() *net.Dialer {
+	return &net.Dialer{Control: s.control}
+}
+
+// Set the options Go overrides once connected.
+func (s *tcpSettings) tune(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(s.noDelay)
+	}
+}
+
+func (s *tcpSettings) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := s.dialer().DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.tune(conn)
+	return conn, nil
+}
+
+// Fail early if the kernel refuses the settings, rather than in every measurement.
+func (s *tcpSettings) check() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	conn, err := s.dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Dial like net.Dial, with the settings.
+func (s *tcpSettings) dial(network string, addr string) (net.Conn, error) {
+	return s.dialContext(context.Background(), network, addr)
+}
+
+// Dial like tls.Dial, with the settings.
+func (s *tcpSettings) dialTls(network string, addr string, config *tls.Config) (*tls.Conn, error) {
+	conn, err := s.dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTls for http2.Transport, which wants a net.Conn.
+func (s *tcpSettings) dialTlsConn(network string, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := s.dialTls(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// A copy of the default HTTP transport that dials with the settings.
+func newHttpTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = tcpTuning.dialContext
+	return transport
+}
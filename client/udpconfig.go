@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/lucas-clemente/quic-go"
+	"golang.org/x/sys/unix"
+)
+
+// UDP socket options of every QUIC connection the client opens, set once per
+// run by the -udp* flags and recorded with every result next to what the kernel
+// actually applied, and next to the server's (see server/udpconfig.go).
+//
+// quic-go asks for a 2 MB receive buffer on every socket; a size set here
+// replaces that request. quic-go reads the ECN bits and packet info of incoming
+// packets when it gets a socket that can read them, which turning ECN off hides
+// from it. quic-go v0.25 reads and writes one packet per system call and does
+// neither GSO nor GRO, so there is no batching or offload to turn on.
+type udpSettings struct {
+	receiveBuffer int // SO_RCVBUF, in bytes
+	sendBuffer    int // SO_SNDBUF, in bytes
+	ecn           bool
+
+	mu        sync.Mutex
+	effective string // what the kernel reported for the last socket
+}
+
+var udpTuning = &udpSettings{ecn: true}
+
+// The server's settings as it reported them, recorded with results.
+var serverUdpTuning = "unknown"
+var serverUdpEffective = "unknown"
+
+// The settings that differ from the defaults, space separated so they fit in a CSV column, or "default".
+func (s *udpSettings) String() string {
+	var labels []string
+	if s.receiveBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("receiveBuffer=%d", s.receiveBuffer))
+	}
+	if s.sendBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("sendBuffer=%d", s.sendBuffer))
+	}
+	if !s.ecn {
+		labels = append(labels, "ecn=false")
+	}
+	if len(labels) == 0 {
+		return "default"
+	}
+	return strings.Join(labels, " ")
+}
+
+// The buffer sizes and ECN state the kernel reported for the last socket, or "unknown" before any.
+func (s *udpSettings) applied() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.effective == "" {
+		return "unknown"
+	}
+	return s.effective
+}
+
+// Set a buffer size, forcing it past the kernel's maximum when allowed to (as root).
+// Linux doubles the size asked for to leave room for its bookkeeping.
+func setSocketBuffer(conn *net.UDPConn, option int, forceOption int, size int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errSet error
+	err = rawConn.Control(func(fd uintptr) {
+		if errSet = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, option, size); errSet != nil {
+			return
+		}
+		if applied, errGet := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, option); errGet == nil && applied < 2*size {
+			unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, forceOption, size)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return errSet
+}
+
+// A UDP socket with the send buffer set, before quic-go sees it.
+func (s *udpSettings) listenUdp(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if s.sendBuffer > 0 {
+		err = setSocketBuffer(conn, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, s.sendBuffer)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("UDP settings %s: %s", s, err)
+	}
+	return conn, nil
+}
+
+// Fail early if the kernel refuses the settings, rather than in every measurement.
+func (s *udpSettings) check() error {
+	conn, err := s.listenUdp("127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := s.setReadBuffer(conn, s.receiveBuffer); s.receiveBuffer > 0 && err != nil {
+		return fmt.Errorf("UDP settings %s: %s", s, err)
+	}
+	return nil
+}
+
+// quic-go asks for its receive buffer as it starts using a socket, which gets the one set instead.
+func (s *udpSettings) setReadBuffer(conn *net.UDPConn, bytes int) error {
+	if s.receiveBuffer > 0 {
+		return setSocketBuffer(conn, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, s.receiveBuffer)
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// tunedUdpConn is still a *net.UDPConn to quic-go, which then reads ECN bits and packet info.
+type tunedUdpConn struct {
+	*net.UDPConn
+	settings *udpSettings
+}
+
+func (c *tunedUdpConn) SetReadBuffer(bytes int) error {
+	return c.settings.setReadBuffer(c.UDPConn, bytes)
+}
+
+// plainUdpConn hides ReadMsgUDP, so quic-go reads packets without ECN bits.
+type plainUdpConn struct {
+	net.PacketConn
+	conn     *net.UDPConn
+	settings *udpSettings
+}
+
+func (c *plainUdpConn) SetReadBuffer(bytes int) error {
+	return c.settings.setReadBuffer(c.conn, bytes)
+}
+
+func (c *plainUdpConn) SyscallConn() (syscall.RawConn, error) {
+	return c.conn.SyscallConn()
+}
+
+// What quic-go gets to use the socket through.
+func (s *udpSettings) wrap(conn *net.UDPConn) net.PacketConn {
+	if s.ecn {
+		return &tunedUdpConn{UDPConn: conn, settings: s}
+	}
+	return &plainUdpConn{PacketConn: conn, conn: conn, settings: s}
+}
+
+// Record what the kernel applied to a socket quic-go has set up.
+func (s *udpSettings) inspect(conn *net.UDPConn) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var receive, send, tos int
+	rawConn.Control(func(fd uintptr) {
+		receive, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		send, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		tos, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.effective = fmt.Sprintf("receive=%d send=%d ecn=%t", receive, send, s.ecn && tos == 1)
+}
+
+// Dial like quic.DialAddr, with the settings. The socket is closed with the session.
+func (s *udpSettings) dial(addr string, tlsConf *tls.Config, config *quic.Config) (quic.Session, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.listenUdp(":0")
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.Dial(s.wrap(conn), remote, addr, tlsConf, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.inspect(conn)
+	go closeWithSession(session.Context(), conn)
+	return session, nil
+}
+
+// Dial like quic.DialAddrEarly, with the settings, for http3.RoundTripper.
+func (s *udpSettings) dialEarly(network string, addr string, tlsConf *tls.Config, config *quic.Config) (quic.EarlySession, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.listenUdp(":0")
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.DialEarly(s.wrap(conn), remote, addr, tlsConf, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.inspect(conn)
+	go closeWithSession(session.Context(), conn)
+	return session, nil
+}
+
+func closeWithSession(ctx context.Context, conn *net.UDPConn) {
+	<-ctx.Done()
+	conn.Close()
+}
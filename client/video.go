@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A DASH-style player: segments are fetched one at a time at the bitrate the
+// throughput estimate allows, into a playback buffer that drains in real time.
+// See server/video.go for the ladder.
+const (
+	videoStartupBuffer = 2 * time.Second  // buffered video needed to start, or resume after a stall
+	videoMaxBuffer     = 12 * time.Second // no new segment is requested while the buffer is this full
+	videoSafetyFactor  = 0.8              // share of the estimated throughput a bitrate may use
+	videoEstimateWidth = 3                // segments in the throughput estimate
+)
+
+type videoManifest struct {
+	SegmentDuration int   `json:"segmentDuration"`
+	Segments        int   `json:"segments"`
+	Bitrates        []int `json:"bitrates"`
+}
+
+// The outcome of a playback session.
+type videoSession struct {
+	startupDelay time.Duration
+	rebuffers    int
+	rebufferTime time.Duration
+	bitrates     []int
+	switches     int
+}
+
+// Pick the highest bitrate under the harmonic mean of the recent segment throughputs (kbps), the lowest to start.
+func chooseBitrate(bitrates []int, throughputs []float64) int {
+	if len(throughputs) == 0 {
+		return bitrates[0]
+	}
+
+	recent := throughputs[len(throughputs)-min(len(throughputs), videoEstimateWidth):]
+	inverseSum := 0.0
+	for _, throughput := range recent {
+		inverseSum += 1 / throughput
+	}
+	estimate := float64(len(recent)) / inverseSum
+
+	chosen := bitrates[0]
+	for _, bitrate := range bitrates {
+		if float64(bitrate) <= estimate*videoSafetyFactor {
+			chosen = bitrate
+		}
+	}
+	return chosen
+}
+
+func fetchVideoManifest(client *http.Client, url string) (*videoManifest, error) {
+	response, err := client.Get(url + "video/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("video manifest: server answered %s", response.Status)
+	}
+	manifest := &videoManifest{}
+	if err := json.NewDecoder(response.Body).Decode(manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Bitrates) == 0 || manifest.Segments <= 0 || manifest.SegmentDuration <= 0 {
+		return nil, fmt.Errorf("video manifest: nothing to play")
+	}
+	return manifest, nil
+}
+
+// Play the whole video once, starting with the manifest request.
+func playVideo(client *http.Client, url string) (*videoSession, error) {
+	sessionStart := time.Now()
+	manifest, err := fetchVideoManifest(client, url)
+	if err != nil {
+		return nil, err
+	}
+	segmentDuration := time.Duration(manifest.SegmentDuration) * time.Second
+
+	session := &videoSession{}
+	var throughputs []float64
+	var buffer time.Duration // video buffered ahead of the playhead
+	playing, started := false, false
+	var stallStart time.Time
+	lastUpdate := time.Now()
+
+	// Drain the buffer for the time played since the last update, noting when it ran dry.
+	drain := func(now time.Time) {
+		if playing {
+			elapsed := now.Sub(lastUpdate)
+			if elapsed >= buffer {
+				stallStart = lastUpdate.Add(buffer)
+				buffer = 0
+				playing = false
+				session.rebuffers++
+			} else {
+				buffer -= elapsed
+			}
+		}
+		lastUpdate = now
+	}
+
+	for segment := 0; segment < manifest.Segments; segment++ {
+		if playing && buffer+segmentDuration > videoMaxBuffer {
+			time.Sleep(buffer + segmentDuration - videoMaxBuffer)
+			drain(time.Now())
+		}
+
+		bitrate := chooseBitrate(manifest.Bitrates, throughputs)
+		if len(session.bitrates) > 0 && session.bitrates[len(session.bitrates)-1] != bitrate {
+			session.switches++
+		}
+
+		segmentStart := time.Now()
+		response, err := client.Get(fmt.Sprintf("%svideo/%d/%d", url, bitrate, segment))
+		if err != nil {
+			return nil, err
+		}
+		received, err := io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("video segment %d at %d kbps: server answered %s", segment, bitrate, response.Status)
+		}
+		downloadTime := time.Since(segmentStart)
+		throughputs = append(throughputs, float64(received)*8/1000/downloadTime.Seconds())
+		session.bitrates = append(session.bitrates, bitrate)
+
+		now := time.Now()
+		drain(now)
+		buffer += segmentDuration
+		if !playing && buffer >= videoStartupBuffer {
+			playing = true
+			if !started {
+				started = true
+				session.startupDelay = now.Sub(sessionStart)
+			} else {
+				session.rebufferTime += now.Sub(stallStart)
+			}
+		}
+	}
+
+	// A video shorter than the startup buffer starts once it's all there.
+	if !started {
+		session.startupDelay = time.Since(sessionStart)
+	} else if !playing {
+		session.rebufferTime += time.Since(stallStart)
+	}
+	return session, nil
+}
+
+func (s *videoSession) averageBitrate() float64 {
+	total := 0
+	for _, bitrate := range s.bitrates {
+		total += bitrate
+	}
+	return float64(total) / float64(len(s.bitrates))
+}
+
+// Append a playback session to the video file of the environment
+func reportVideo(protocol string, environment string, session *videoSession) {
+	fmt.Printf("[%s - %s] [%d segments] startup: %s, rebuffers: %d (%s), average bitrate: %.0f kbps, switches: %d\n", protocol, environment, len(session.bitrates), session.startupDelay, session.rebuffers, session.rebufferTime, session.averageBitrate(), session.switches)
+
+	fileName := outputFile("video", environment)
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	f.WriteString(fmt.Sprintf("%s,%s,%d,", protocol, environment, len(session.bitrates)))
+	f.WriteString(fmt.Sprintf("%d,%d,%d,", session.startupDelay.Microseconds(), session.rebuffers, session.rebufferTime.Microseconds()))
+	f.WriteString(fmt.Sprintf("%f,%d", session.averageBitrate(), session.switches))
+	f.WriteString(settingsColumns())
+	f.WriteString("\n")
+}
+
+// Stream the video once over one HTTP version, on a new connection.
+func clientVideoMain(environment string, host string, port int, variant string) error {
+	fmt.Printf("Testing %s video streaming...\n", variant)
+	protocolName := fmt.Sprintf("%s Video", variant) // for report and logging strings
+
+	transport, url, err := newWorkloadTransport(variant, host, port)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport}
+	defer client.CloseIdleConnections()
+	if closer, ok := transport.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	session, err := playVideo(client, url)
+	if err != nil {
+		return err
+	}
+	reportVideo(protocolName, environment, session)
+	return nil
+}
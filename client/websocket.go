@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	webSocketOpBinary = 0x2
+	webSocketOpClose  = 0x8
+	webSocketOpPing   = 0x9
+	webSocketOpPong   = 0xa
+)
+
+// The ways a WebSocket is bootstrapped, one report row each.
+const (
+	webSocketHttp    = "HTTP/1"
+	webSocketHttpTls = "HTTP/1 TLS"
+	webSocketHttp2   = "HTTP/2"
+)
+
+// webSocketConn sends every Write as a single binary message, and Read returns the payload of incoming data messages.
+type webSocketConn struct {
+	r         io.Reader
+	w         io.Writer
+	closer    io.Closer
+	remaining uint64 // payload bytes left in the frame being read
+
+	writeMu sync.Mutex // pongs are written from Read
+	frame   []byte     // reused for masking outgoing frames
+}
+
+func newWebSocketConn(r io.Reader, w io.Writer, closer io.Closer) *webSocketConn {
+	return &webSocketConn{r: r, w: w, closer: closer}
+}
+
+// Upgrade an HTTP/1.1 connection (optionally over TLS) to a WebSocket.
+func dialWebSocket(host string, port int, useTls bool) (*webSocketConn, error) {
+	url := fmt.Sprintf("%s:%d", host, port)
+
+	var conn net.Conn
+	var err error
+	if useTls {
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		}
+		conn, err = tcpTuning.dialTls("tcp", url, tlsConf)
+	} else {
+		conn, err = tcpTuning.dial("tcp", url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	request := fmt.Sprintf("GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", url, key)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket: server answered upgrade with status %s", response.Status)
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	if response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(hash[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket: invalid Sec-WebSocket-Accept")
+	}
+
+	return newWebSocketConn(reader, conn, conn), nil
+}
+
+// Write sends data as one masked binary frame, as required from clients.
+func (c *webSocketConn) Write(data []byte) (int, error) {
+	return len(data), c.writeFrame(webSocketOpBinary, data)
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	length := len(payload)
+	if cap(c.frame) < length+14 {
+		c.frame = make([]byte, 0, length+14)
+	}
+	frame := append(c.frame[:0], 0x80|opcode)
+
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	var maskKey [4]byte
+	binary.BigEndian.PutUint32(maskKey[:], rand.Uint32())
+	frame = append(frame, maskKey[:]...)
+
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= maskKey[i%4]
+	}
+
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// Read returns payload bytes of data frames, answering pings and skipping other control frames.
+func (c *webSocketConn) Read(buf []byte) (int, error) {
+	header := make([]byte, 8)
+	for c.remaining == 0 {
+		if _, err := io.ReadFull(c.r, header[:2]); err != nil {
+			return 0, err
+		}
+		opcode := header[0] & 0x0f
+		length := uint64(header[1] & 0x7f)
+
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(c.r, header[:2]); err != nil {
+				return 0, err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[:2]))
+		case 127:
+			if _, err := io.ReadFull(c.r, header[:8]); err != nil {
+				return 0, err
+			}
+			length = binary.BigEndian.Uint64(header[:8])
+		}
+
+		switch opcode {
+		case webSocketOpPing:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return 0, err
+			}
+			if err := c.writeFrame(webSocketOpPong, payload); err != nil {
+				return 0, err
+			}
+		case webSocketOpPong:
+			if _, err := io.CopyN(ioutil.Discard, c.r, int64(length)); err != nil {
+				return 0, err
+			}
+		case webSocketOpClose:
+			return 0, io.EOF
+		default:
+			c.remaining = length
+		}
+	}
+
+	// Acknowledgements are tiny frames, read them whole so flood always sees the full size.
+	current := uint64(len(buf))
+	if current > c.remaining {
+		current = c.remaining
+	}
+	n, err := io.ReadFull(c.r, buf[:current])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *webSocketConn) Close() error {
+	c.writeFrame(webSocketOpClose, nil)
+	return c.closer.Close()
+}
+
+func clientWebSocketMain(environment string, host string, port int, variant string) error {
+	fmt.Printf("Testing WebSocket (%s)...\n", variant)
+	protocolName := fmt.Sprintf("WebSocket (%s)", variant) // for report and logging strings
+
+	size := initialMessageSize
+	for size <= finalMessageSize {
+		memoryBefore, err2 := memory.Get()
+		if err2 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err2)
+			return err2
+		}
+
+		cpuBefore, err1 := cpu.Get()
+		if err1 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err1)
+			return err1
+		}
+
+		start := time.Now()
+
+		var session *webSocketConn
+		var err error
+		switch variant {
+		case webSocketHttp:
+			session, err = dialWebSocket(host, port, false)
+		case webSocketHttpTls:
+			session, err = dialWebSocket(host, port, true)
+		case webSocketHttp2:
+			session, err = dialWebSocketH2(host, port)
+		default:
+			err = fmt.Errorf("unknown WebSocket variant %q", variant)
+		}
+		if err != nil {
+			return err
+		}
+
+		setupDuration := time.Since(start)
+		getFirstByte(protocolName, environment, session.Write, session.Read)
+		firstByteDuration := time.Since(start)
+
+		floodStart := time.Now()
+		for fileNum := 0; fileNum < filesToSend; fileNum++ {
+			err = flood(protocolName, environment, size, session.Write, session.Read)
+		}
+		duration := time.Since(floodStart)
+		session.Close()
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			cpuAfter, err1 := cpu.Get()
+			if err1 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err1)
+				return err1
+			}
+			memoryAfter, err2 := memory.Get()
+			if err2 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err2)
+				return err2
+			}
+			report(protocolName, environment, "WebSocket", filesToSend, setupDuration, firstByteDuration, size, duration, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+		}
+
+		size *= 2
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"github.com/marten-seemann/qpack"
+)
+
+// WebTransport framing from draft-ietf-webtrans-http3, see server/webtransport.go.
+const (
+	h3StreamTypeControl       = 0x00
+	h3FrameTypeHeaders        = 0x01
+	h3FrameTypeSettings       = 0x04
+	h3SettingEnableConnect    = 0x08
+	h3SettingDatagram         = 0xffd277
+	h3SettingEnableWebTrans   = 0x2b603742
+	webTransportUniStreamType = 0x54
+	webTransportBidiSignal    = 0x41
+	webTransportDatagramSize  = 1024 // fits in a single DATAGRAM frame with quic-go's default limits
+	webTransportAckTimeout    = 2 * time.Second
+)
+
+// The WebTransport modes exercised by the client, one report row each.
+var webTransportModes = []string{"Bidi", "Uni", "Datagram"}
+
+type webTransportSession struct {
+	sess      quic.Session
+	sessionID uint64
+	uniAcks   chan int
+	dgramAcks chan datagramAck
+	transfers uint64 // datagram transfers so far, each one's ID
+}
+
+// A datagram acknowledgement, of the transfer its datagram was part of.
+type datagramAck struct {
+	transfer uint64
+	size     int
+}
+
+func dialWebTransport(host string, port int) (*webTransportSession, error) {
+	url := fmt.Sprintf("%s:%d", host, port)
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h3"},
+	}
+	quicConf := legacyQuicConfig(quicTuning.options(quicOptions{keepAlive: true, datagrams: true}))
+
+	sess, err := udpTuning.dial(url, tlsConf, quicConf)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := sess.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3StreamTypeControl)
+	writeWebTransportSettings(buf)
+	if _, err := control.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	connectStream, err := sess.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	err = writeWebTransportHeaders(connectStream, []qpack.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":protocol", Value: "webtransport"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: url},
+		{Name: ":path", Value: "/webtransport"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := readWebTransportHeaders(connectStream)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if field.Name == ":status" && field.Value != "200" {
+			return nil, fmt.Errorf("WebTransport: server answered CONNECT with status %s", field.Value)
+		}
+	}
+
+	wt := &webTransportSession{
+		sess:      sess,
+		sessionID: uint64(connectStream.StreamID()),
+		uniAcks:   make(chan int, 16),
+		dgramAcks: make(chan datagramAck, 1024),
+	}
+	go wt.acceptUniAcks()
+	go wt.receiveDatagramAcks()
+
+	return wt, nil
+}
+
+func writeWebTransportSettings(buf *bytes.Buffer) {
+	settings := &bytes.Buffer{}
+	quicvarint.Write(settings, h3SettingEnableConnect)
+	quicvarint.Write(settings, 1)
+	quicvarint.Write(settings, h3SettingDatagram)
+	quicvarint.Write(settings, 1)
+	quicvarint.Write(settings, h3SettingEnableWebTrans)
+	quicvarint.Write(settings, 1)
+
+	quicvarint.Write(buf, h3FrameTypeSettings)
+	quicvarint.Write(buf, uint64(settings.Len()))
+	buf.Write(settings.Bytes())
+}
+
+func readWebTransportHeaders(r io.Reader) ([]qpack.HeaderField, error) {
+	qr := quicvarint.NewReader(r)
+	frameType, err := quicvarint.Read(qr)
+	if err != nil {
+		return nil, err
+	}
+	length, err := quicvarint.Read(qr)
+	if err != nil {
+		return nil, err
+	}
+	if frameType != h3FrameTypeHeaders {
+		return nil, fmt.Errorf("expected HEADERS frame, got 0x%x", frameType)
+	}
+
+	headerBlock := make([]byte, length)
+	if _, err := io.ReadFull(r, headerBlock); err != nil {
+		return nil, err
+	}
+	return qpack.NewDecoder(nil).DecodeFull(headerBlock)
+}
+
+func writeWebTransportHeaders(w io.Writer, fields []qpack.HeaderField) error {
+	headerBlock := &bytes.Buffer{}
+	encoder := qpack.NewEncoder(headerBlock)
+	for _, field := range fields {
+		if err := encoder.WriteField(field); err != nil {
+			return err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3FrameTypeHeaders)
+	quicvarint.Write(buf, uint64(headerBlock.Len()))
+	buf.Write(headerBlock.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func parseAck(buf []byte) int {
+	sizeRecv, _ := strconv.Atoi(string(bytes.Trim(buf, "\x00")))
+	return sizeRecv
+}
+
+// The server acknowledges each unidirectional stream on a stream of its own.
+func (wt *webTransportSession) acceptUniAcks() {
+	for {
+		stream, err := wt.sess.AcceptUniStream(context.Background())
+		if err != nil {
+			close(wt.uniAcks)
+			return
+		}
+
+		go func(stream quic.ReceiveStream) {
+			qr := quicvarint.NewReader(stream)
+			streamType, err := quicvarint.Read(qr)
+			if err != nil || streamType != webTransportUniStreamType {
+				io.Copy(ioutil.Discard, stream) // the server's control stream
+				return
+			}
+			if _, err := quicvarint.Read(qr); err != nil {
+				return
+			}
+
+			buf := make([]byte, 8)
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				return
+			}
+			wt.uniAcks <- parseAck(buf)
+		}(stream)
+	}
+}
+
+func (wt *webTransportSession) receiveDatagramAcks() {
+	for {
+		message, err := wt.sess.ReceiveMessage()
+		if err != nil {
+			close(wt.dgramAcks)
+			return
+		}
+
+		reader := bytes.NewReader(message)
+		if _, err := quicvarint.Read(reader); err != nil {
+			continue
+		}
+		transfer, err := quicvarint.Read(reader)
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			continue
+		}
+
+		select {
+		case wt.dgramAcks <- datagramAck{transfer: transfer, size: parseAck(buf)}:
+		default:
+		}
+	}
+}
+
+func (wt *webTransportSession) openBidiStream() (quic.Stream, error) {
+	stream, err := wt.sess.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, webTransportBidiSignal)
+	quicvarint.Write(buf, wt.sessionID)
+	if _, err := stream.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Send size bytes on a fresh unidirectional stream and wait for the server's acknowledgement.
+// The sampler, if any, counts the bytes the stream has taken.
+func (wt *webTransportSession) floodUni(size int, sampler *transferSampler) error {
+	stream, err := wt.sess.OpenUniStreamSync(context.Background())
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, webTransportUniStreamType)
+	quicvarint.Write(buf, wt.sessionID)
+	if _, err := stream.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	totalSent := 0
+	for totalSent < size {
+		current := min(size-totalSent, writeChunkSize)
+		if _, err := stream.Write(dataBuffer[totalSent : totalSent+current]); err != nil {
+			return err
+		}
+		sampler.add(current)
+		totalSent += current
+	}
+	stream.Close()
+
+	received, ok := <-wt.uniAcks
+	if !ok || received != size {
+		return fmt.Errorf("WebTransport (Uni): %d did not finish", size)
+	}
+	return nil
+}
+
+// Send size bytes as datagrams and wait until the server has acknowledged them all,
+// or until acknowledgements stop arriving, returning how many bytes were acknowledged.
+// Datagrams are unreliable, so losing some is part of the measurement, not an error.
+// Every datagram carries the ID of its transfer, so late acknowledgements of an
+// earlier transfer don't count toward this one. The sampler, if any, counts the acknowledged bytes.
+func (wt *webTransportSession) floodDatagram(size int, sampler *transferSampler) (int, error) {
+	wt.transfers++
+	transfer := wt.transfers
+	prefix := &bytes.Buffer{}
+	quicvarint.Write(prefix, wt.sessionID/4)
+	quicvarint.Write(prefix, transfer)
+	payloadSize := webTransportDatagramSize - prefix.Len()
+
+	done := make(chan struct{}) // closed if sending fails, so the acks are left to the next transfer
+	received := 0
+	finishedRecv := goWorker(func() error {
+		for received < size {
+			select {
+			case ack, ok := <-wt.dgramAcks:
+				if !ok {
+					return nil
+				}
+				if ack.transfer == transfer {
+					received += ack.size
+					sampler.add(ack.size)
+				}
+			case <-time.After(webTransportAckTimeout):
+				return nil
+			case <-done:
+				return nil
+			}
+		}
+		return nil
+	})
+
+	message := make([]byte, webTransportDatagramSize)
+	copy(message, prefix.Bytes())
+	totalSent := 0
+	for totalSent < size {
+		current := min(size-totalSent, payloadSize)
+		copy(message[prefix.Len():], dataBuffer[totalSent:totalSent+current])
+		if err := wt.sess.SendMessage(message[:prefix.Len()+current]); err != nil {
+			close(done)
+			<-finishedRecv
+			return received, err
+		}
+		totalSent += current
+	}
+
+	err := <-finishedRecv
+	return received, err
+}
+
+func clientWebTransportMain(environment string, host string, webTransportPort int, mode string) error {
+	if !builtinQuicOnly("WebTransport") {
+		return nil
+	}
+	fmt.Printf("Testing WebTransport (%s)...\n", mode)
+	protocolName := fmt.Sprintf("WebTransport (%s)", mode) // for report and logging strings
+
+	// A failed size doesn't stop the larger ones, but fails the measurement.
+	var firstErr error
+	size := initialMessageSize
+	for size <= finalMessageSize {
+
+		memoryBefore, err2 := memory.Get()
+		if err2 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err2)
+			return err2
+		}
+
+		cpuBefore, err1 := cpu.Get()
+		if err1 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err1)
+			return err1
+		}
+
+		start := time.Now()
+		wt, err := dialWebTransport(host, webTransportPort)
+		if err != nil {
+			return err
+		}
+
+		err = measureWebTransport(wt, protocolName, environment, mode, start, size, memoryBefore, cpuBefore)
+		wt.sess.CloseWithError(0, "")
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		size *= 2
+	}
+	return firstErr
+}
+
+// Run the transfers of one size over a WebTransport session dialed at start, and report them.
+// Every mode but Datagram either delivers everything or fails.
+func measureWebTransport(wt *webTransportSession, protocolName string, environment string, mode string, start time.Time, size int,
+	memoryBefore *memory.Stats, cpuBefore *cpu.Stats) error {
+	var firstByte func() error
+	var send func(size int) (int, error)
+	switch mode {
+	case "Bidi":
+		stream, err := wt.openBidiStream()
+		if err != nil {
+			return err
+		}
+		firstByte = func() error { return getFirstByte(protocolName, environment, stream.Write, stream.Read) }
+		send = func(size int) (int, error) {
+			return size, flood(protocolName, environment, size, stream.Write, stream.Read)
+		}
+	case "Uni":
+		firstByte = func() error { return wt.floodUni(1, nil) }
+		send = func(size int) (int, error) {
+			sampler := startSampler(protocolName, environment, measureSent, size)
+			err := wt.floodUni(size, sampler)
+			sampler.finish(err == nil)
+			return size, err
+		}
+	case "Datagram":
+		firstByte = func() error {
+			_, err := wt.floodDatagram(1, nil)
+			return err
+		}
+		send = func(size int) (int, error) {
+			sampler := startSampler(protocolName, environment, measureAcknowledged, size)
+			acknowledged, err := wt.floodDatagram(size, sampler)
+			sampler.finish(err == nil)
+			return acknowledged, err
+		}
+	default:
+		return fmt.Errorf("unknown WebTransport mode %q", mode)
+	}
+
+	setupDuration := time.Since(start)
+	if err := firstByte(); err != nil {
+		fmt.Println(err)
+		return err
+	}
+	firstByteDuration := time.Since(start)
+
+	var err error
+	acknowledged := 0
+	floodStart := time.Now()
+	for fileNum := 0; fileNum < filesToSend && err == nil; fileNum++ {
+		var received int
+		received, err = send(size)
+		acknowledged += received
+	}
+	duration := time.Since(floodStart)
+
+	return reportWebTransport(protocolName, environment, setupDuration, firstByteDuration, size, duration, acknowledged, err, memoryBefore, cpuBefore)
+}
+
+func reportWebTransport(protocolName string, environment string, setupDuration time.Duration, firstByteDuration time.Duration, size int,
+	duration time.Duration, acknowledged int, floodErr error, memoryBefore *memory.Stats, cpuBefore *cpu.Stats) error {
+	if floodErr != nil {
+		fmt.Println(floodErr)
+		return floodErr
+	}
+
+	cpuAfter, err1 := cpu.Get()
+	if err1 != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err1)
+		return err1
+	}
+
+	memoryAfter, err2 := memory.Get()
+	if err2 != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err2)
+		return err2
+	}
+	reportDelivered(protocolName, environment, "WebTransport", filesToSend, setupDuration, firstByteDuration, size, duration, acknowledged, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"golang.org/x/net/http2"
+)
+
+// The uploads of floodHttp only get an 8-byte length back. These workloads move
+// bulk data the other ways, see server/workloads.go.
+const (
+	workloadDownload      = "Download"      // GET /bytes/<n>
+	workloadEcho          = "Echo"          // POST /echo, the full payload comes back
+	workloadBidirectional = "Bidirectional" // an upload and a download of n bytes at the same time
+)
+
+var httpWorkloads = []string{workloadDownload, workloadEcho, workloadBidirectional}
+
+// The HTTP versions the workloads run over, named as in the upload reports.
+const (
+	httpVariantHttp1    = "HTTP/1"
+	httpVariantHttp1Tls = "HTTP/1 (TLS)"
+	httpVariantH2c      = "HTTP/2 (h2c)"
+	httpVariantHttp2    = "HTTP/2"
+	httpVariantHttp3    = "HTTP/3 (QUIC)"
+)
+
+// Build the transport for variant, and the base url it serves on port.
+func newWorkloadTransport(variant string, host string, port int) (http.RoundTripper, string, error) {
+	switch variant {
+	case httpVariantHttp1:
+		return newHttpTransport(), fmt.Sprintf("http://%s:%d/", host, port), nil
+	case httpVariantHttp1Tls:
+		return newHttp1TlsTransport(), fmt.Sprintf("https://%s:%d/", host, port), nil
+	case httpVariantH2c:
+		transport := &http2.Transport{
+			StrictMaxConcurrentStreams: true,
+			AllowHTTP:                  true,
+			DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return tcpTuning.dial(network, addr)
+			},
+		}
+		return transport, fmt.Sprintf("http://%s:%d/", host, port), nil
+	case httpVariantHttp2:
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2"},
+		}
+		return &http2.Transport{TLSClientConfig: tlsConf, StrictMaxConcurrentStreams: true, DialTLS: tcpTuning.dialTlsConn}, fmt.Sprintf("https://%s:%d/", host, port), nil
+	case httpVariantHttp3:
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h3"},
+		}
+		quicConfig := quicTuning.options(quicOptions{keepAlive: true})
+		return quicImplementation.http3Transport(tlsConf, quicConfig), fmt.Sprintf("https://%s:%d/", host, port), nil
+	}
+	return nil, "", fmt.Errorf("unknown HTTP variant %q", variant)
+}
+
+// Read a response body to the end and check it holds size bytes.
+func readHttpBody(response *http.Response, size int) error {
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", response.Request.URL.Path, response.Status)
+	}
+	received, err := io.Copy(ioutil.Discard, response.Body)
+	if err != nil {
+		return err
+	}
+	if int(received) != size {
+		return fmt.Errorf("%s: %d did not finish, received %d", response.Request.URL.Path, size, received)
+	}
+	return nil
+}
+
+func downloadHttp(client *http.Client, url string, size int) error {
+	response, err := client.Get(fmt.Sprintf("%sbytes/%d", url, size))
+	if err != nil {
+		return err
+	}
+	return readHttpBody(response, size)
+}
+
+func echoHttp(client *http.Client, url string, sizeIndex int) error {
+	response, err := client.Post(url+"echo", "application/octet-stream", bytes.NewReader(httpByteBuffer[sizeIndex]))
+	if err != nil {
+		return err
+	}
+	return readHttpBody(response, len(httpByteBuffer[sizeIndex]))
+}
+
+// Upload and download size bytes at once, over the same connection where the protocol multiplexes.
+func bidirectionalHttp(protocol string, environment string, client *http.Client, url string, size int, sizeIndex int) error {
+	uploadErr := goWorker(func() error {
+		return floodHttp(protocol, environment, size, sizeIndex, client, url)
+	})
+
+	err := downloadHttp(client, url, size)
+	if errUpload := <-uploadErr; err == nil {
+		err = errUpload
+	}
+	return err
+}
+
+// Run a bulk workload over one HTTP version. For the bidirectional workload, goodput counts a single direction.
+func clientHttpWorkloadMain(environment string, host string, port int, variant string, workload string) error {
+	fmt.Printf("Testing %s %s...\n", variant, workload)
+	protocolName := fmt.Sprintf("%s %s", variant, workload) // for report and logging strings
+
+	transport, url, err := newWorkloadTransport(variant, host, port)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport}
+	defer client.CloseIdleConnections()
+	if closer, ok := transport.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	size := initialMessageSize
+	sizeIndex := 0
+	for size <= finalMessageSize {
+		memoryBefore, err2 := memory.Get()
+		if err2 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err2)
+			return err2
+		}
+
+		cpuBefore, err1 := cpu.Get()
+		if err1 != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err1)
+			return err1
+		}
+
+		// The connection is the transport's, kept from one size to the next: these rows have no setup.
+		start := time.Now()
+		getFirstByteHttp(protocolName, environment, client, url)
+		firstByteDuration := time.Since(start)
+
+		floodStart := time.Now()
+		for fileNum := 0; fileNum < filesToSend && err == nil; fileNum++ {
+			switch workload {
+			case workloadDownload:
+				err = downloadHttp(client, url, size)
+			case workloadEcho:
+				err = echoHttp(client, url, sizeIndex)
+			case workloadBidirectional:
+				err = bidirectionalHttp(protocolName, environment, client, url, size, sizeIndex)
+			default:
+				return fmt.Errorf("unknown HTTP workload %q", workload)
+			}
+		}
+		duration := time.Since(floodStart)
+
+		if err != nil {
+			fmt.Println(err)
+			err = nil
+		} else {
+			cpuAfter, err1 := cpu.Get()
+			if err1 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err1)
+				return err1
+			}
+			memoryAfter, err2 := memory.Get()
+			if err2 != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err2)
+				return err2
+			}
+			report(protocolName, environment, "HTTP", filesToSend, noSetup, firstByteDuration, size, duration, memoryBefore, memoryAfter, cpuBefore, cpuAfter)
+		}
+
+		size *= 2
+		sizeIndex++
+	}
+	return nil
+}
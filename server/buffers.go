@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// How the server sizes and reuses its application buffers, set by the -readBuffer,
+// -writeChunk and -bufferReuse flags so their cost shows up in experiments
+// instead of hiding in every Read. The settings in use are reported by /stats.
+type bufferSettings struct {
+	readSize   int    // bytes asked of every Read of the echo servers
+	writeChunk int    // largest Write of downloads and RPC, gRPC and HTTP responses
+	reuse      string // one of the bufferReuse* strategies
+}
+
+const (
+	bufferReuseFresh      = "fresh"      // a new buffer for every Read
+	bufferReuseConnection = "connection" // one buffer per connection or stream
+	bufferReusePool       = "pool"       // buffers shared through a sync.Pool
+)
+
+var bufferTuning = &bufferSettings{readSize: bufferMaxSize, writeChunk: bufferMaxSize, reuse: bufferReuseConnection}
+
+var bufferPool = sync.Pool{}
+
+func (s *bufferSettings) check() error {
+	if s.readSize <= 0 || s.writeChunk <= 0 {
+		return fmt.Errorf("buffer sizes must be positive, got read %d and write %d", s.readSize, s.writeChunk)
+	}
+	if s.reuse != bufferReuseFresh && s.reuse != bufferReuseConnection && s.reuse != bufferReusePool {
+		return fmt.Errorf("invalid buffer reuse %q, expected %s, %s or %s", s.reuse, bufferReuseFresh, bufferReuseConnection, bufferReusePool)
+	}
+	return nil
+}
+
+func (s *bufferSettings) String() string {
+	return fmt.Sprintf("read=%d write=%d reuse=%s", s.readSize, s.writeChunk, s.reuse)
+}
+
+// The read buffers of one connection or stream.
+type readBuffers struct {
+	settings *bufferSettings
+	buf      []byte
+}
+
+func (s *bufferSettings) buffers() *readBuffers {
+	return &readBuffers{settings: s}
+}
+
+// A buffer to Read into, to hand back with put once its content is used.
+func (b *readBuffers) get() []byte {
+	switch b.settings.reuse {
+	case bufferReuseConnection:
+		if b.buf == nil {
+			b.buf = make([]byte, b.settings.readSize)
+		}
+		return b.buf
+	case bufferReusePool:
+		if buf, ok := bufferPool.Get().(*[]byte); ok && len(*buf) == b.settings.readSize {
+			return *buf
+		}
+	}
+	return make([]byte, b.settings.readSize)
+}
+
+func (b *readBuffers) put(buf []byte) {
+	if b.settings.reuse == bufferReusePool {
+		bufferPool.Put(&buf)
+	}
+}
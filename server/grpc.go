@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const grpcMaxMessageSize = 67108864 + 1024 // 64mb, the largest message the client sends, plus room for framing
+
+// Zeros are as good as random data here, since gRPC messages are never compressed.
+// main sizes it to the write chunk.
+var grpcResponseData = make([]byte, bufferMaxSize)
+
+// grpcBytesCodec passes raw byte slices through, so the echo service needs no generated protobuf code.
+type grpcBytesCodec struct{}
+
+func (grpcBytesCodec) Marshal(v interface{}) ([]byte, error) {
+	switch message := v.(type) {
+	case []byte:
+		return message, nil
+	case *[]byte:
+		return *message, nil
+	}
+	return nil, fmt.Errorf("grpcBytesCodec: cannot marshal %T", v)
+}
+
+func (grpcBytesCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpcBytesCodec: cannot unmarshal into %T", v)
+	}
+	*message = data
+	return nil
+}
+
+func (grpcBytesCodec) Name() string {
+	return "bytes"
+}
+
+// grpcMessageStream is the part of grpc.ServerStream the echo service uses, so it can also run over HTTP/3.
+type grpcMessageStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+var grpcEchoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "benchmark.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Unary",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				var request []byte
+				if err := dec(&request); err != nil {
+					return nil, err
+				}
+				return grpcAck(len(request)), nil
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ClientStream",
+			Handler:       func(srv interface{}, stream grpc.ServerStream) error { return grpcClientStream(stream) },
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ServerStream",
+			Handler:       func(srv interface{}, stream grpc.ServerStream) error { return grpcServerStream(stream) },
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Bidi",
+			Handler:       func(srv interface{}, stream grpc.ServerStream) error { return grpcBidi(stream) },
+			ClientStreams: true,
+			ServerStreams: true,
+		},
+	},
+}
+
+// Acknowledgements carry the received size, same as the other echo servers.
+func grpcAck(size int) []byte {
+	return pad([]byte(fmt.Sprintf("%d", size)), 8)
+}
+
+func grpcUnary(stream grpcMessageStream) error {
+	var request []byte
+	if err := stream.RecvMsg(&request); err != nil {
+		return err
+	}
+	return stream.SendMsg(grpcAck(len(request)))
+}
+
+// Receive messages until the client closes its side, then acknowledge the total.
+func grpcClientStream(stream grpcMessageStream) error {
+	totalBytes := 0
+	for {
+		var request []byte
+		err := stream.RecvMsg(&request)
+		if err == io.EOF {
+			return stream.SendMsg(grpcAck(totalBytes))
+		}
+		if err != nil {
+			return err
+		}
+		totalBytes += len(request)
+	}
+}
+
+// The request holds the number of bytes to stream back, sent in chunks of at most the write chunk size.
+func grpcServerStream(stream grpcMessageStream) error {
+	var request []byte
+	if err := stream.RecvMsg(&request); err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.Trim(string(request), "\x00"))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid size %q", request)
+	}
+
+	for left := size; left > 0; {
+		current := min(left, bufferTuning.writeChunk)
+		if err := stream.SendMsg(grpcResponseData[:current]); err != nil {
+			return err
+		}
+		left -= current
+	}
+	return nil
+}
+
+// Acknowledge every message as it arrives, like handleQuicStream does for every read.
+func grpcBidi(stream grpcMessageStream) error {
+	for {
+		var request []byte
+		err := stream.RecvMsg(&request)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(grpcAck(len(request))); err != nil {
+			return err
+		}
+	}
+}
+
+// Start a gRPC echo service on top of HTTP/2 (using TLS)
+func echoGrpcServer(host string, grpcPort int) error {
+
+	listener, err := tcpTuning.listen("tcp", fmt.Sprintf("%s:%d", host, grpcPort))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(generateTLSConfig())),
+		grpc.ForceServerCodec(grpcBytesCodec{}),
+		grpc.MaxRecvMsgSize(grpcMaxMessageSize),
+		grpc.MaxSendMsgSize(grpcMaxMessageSize),
+	)
+	server.RegisterService(&grpcEchoServiceDesc, struct{}{})
+	fmt.Printf("Started gRPC server! %s:%d\n", host, grpcPort)
+
+	return server.Serve(listener)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/marten-seemann/qpack"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpc-go only runs over its own HTTP/2 transport, and quic-go v0.25's http3
+// package can't send trailers. So for HTTP/3 the handler takes over the request
+// stream and speaks the gRPC wire protocol itself: length-prefixed messages in
+// DATA frames, and the status in a trailing HEADERS frame.
+const h3FrameTypeData = 0x00
+
+type grpcHttp3Stream struct {
+	str       quic.Stream
+	remaining uint64 // bytes left in the DATA frame being read
+}
+
+// Read returns request body bytes, skipping the HTTP/3 framing around them.
+func (s *grpcHttp3Stream) Read(buf []byte) (int, error) {
+	for s.remaining == 0 {
+		qr := quicvarint.NewReader(s.str)
+		frameType, err := quicvarint.Read(qr)
+		if err != nil {
+			return 0, err
+		}
+		length, err := quicvarint.Read(qr)
+		if err != nil {
+			return 0, err
+		}
+
+		if frameType == h3FrameTypeData {
+			s.remaining = length
+		} else if _, err := io.CopyN(ioutil.Discard, s.str, int64(length)); err != nil {
+			// Request trailers and unknown frames
+			return 0, err
+		}
+	}
+
+	if uint64(len(buf)) > s.remaining {
+		buf = buf[:s.remaining]
+	}
+	n, err := s.str.Read(buf)
+	s.remaining -= uint64(n)
+	return n, err
+}
+
+func (s *grpcHttp3Stream) RecvMsg(m interface{}) error {
+	message, ok := m.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpcHttp3Stream: cannot receive into %T", m)
+	}
+
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(s, prefix); err != nil {
+		return err // io.EOF between messages is the client closing its side
+	}
+	if prefix[0] != 0 {
+		return status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > grpcMaxMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "message of %d bytes is too large", length)
+	}
+
+	*message = make([]byte, length)
+	if _, err := io.ReadFull(s, *message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *grpcHttp3Stream) SendMsg(m interface{}) error {
+	message, err := grpcBytesCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3FrameTypeData)
+	quicvarint.Write(buf, uint64(5+len(message)))
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, uint32(len(message)))
+	if _, err := s.str.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err = s.str.Write(message)
+	return err
+}
+
+func (s *grpcHttp3Stream) writeTrailers(err error) error {
+	st := status.Convert(err)
+
+	headerBlock := &bytes.Buffer{}
+	encoder := qpack.NewEncoder(headerBlock)
+	encoder.WriteField(qpack.HeaderField{Name: "grpc-status", Value: strconv.Itoa(int(st.Code()))})
+	if st.Message() != "" {
+		encoder.WriteField(qpack.HeaderField{Name: "grpc-message", Value: st.Message()})
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3FrameTypeHeaders)
+	quicvarint.Write(buf, uint64(headerBlock.Len()))
+	buf.Write(headerBlock.Bytes())
+	_, err = s.str.Write(buf.Bytes())
+	return err
+}
+
+// GrpcHttp3Handler serves the echo service over HTTP/3 using the gRPC wire protocol
+func GrpcHttp3Handler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost || !strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(writer, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	streamer, ok := writer.(http3.DataStreamer)
+	if !ok {
+		http.Error(writer, "gRPC over HTTP/3 requires the http3 server", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/grpc")
+	writer.WriteHeader(http.StatusOK)
+	str := streamer.DataStream()
+	defer str.Close()
+
+	stream := &grpcHttp3Stream{str: str}
+
+	var err error
+	switch strings.TrimPrefix(request.URL.Path, "/"+grpcEchoServiceDesc.ServiceName+"/") {
+	case "Unary":
+		err = grpcUnary(stream)
+	case "ClientStream":
+		err = grpcClientStream(stream)
+	case "ServerStream":
+		err = grpcServerStream(stream)
+	case "Bidi":
+		err = grpcBidi(stream)
+	default:
+		err = status.Errorf(codes.Unimplemented, "unknown method %s", request.URL.Path)
+	}
+
+	stream.writeTrailers(err)
+}
+
+// Start a gRPC echo service on top of HTTP/3
+func echoGrpcHttp3Server(host string, grpcPort int) {
+
+	sslCert := generateTLSConfig()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", GrpcHttp3Handler)
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", host, grpcPort),
+		Handler:   mux,
+		TLSConfig: sslCert,
+	}
+
+	quicConf := quicTuning.config(&quic.Config{MaxIncomingStreams: 128, MaxIncomingUniStreams: 128})
+	http3Server := &http3.Server{Server: server, QuicConfig: quicConf}
+	fmt.Printf("Started gRPC HTTP3 server! %s:%d\n", host, grpcPort)
+
+	conn, err := udpTuning.listenUdp(server.Addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	http3Server.Serve(udpTuning.wrap(conn))
+}
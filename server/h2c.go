@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+// The HTTP port also speaks h2c (cleartext HTTP/2), so HTTP/1.1 and HTTP/2 can
+// be compared with and without TLS. Prior knowledge is left to x/net's h2c
+// handler, but its Upgrade support drops the request body, so upgrades are
+// handled here: the HTTP/1.1 request is replayed to the HTTP/2 server as
+// stream 1, followed by whatever the client sends after its preface.
+const h2cMaxUpgradeBody = 65535 // the default HTTP/2 window, all a client may send before the server's SETTINGS
+
+// h2cConn is a hijacked connection whose first bytes are synthesized frames.
+type h2cConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *h2cConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func isH2cUpgrade(request *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(request.Header["Upgrade"], "h2c") &&
+		httpguts.HeaderValuesContainsToken(request.Header["Connection"], "HTTP2-Settings")
+}
+
+// Encode the upgrade request as the frames a client would have sent for it on stream 1.
+func h2cUpgradeFrames(request *http.Request, settings []byte, body []byte) (*bytes.Buffer, error) {
+	frames := bytes.NewBufferString(http2.ClientPreface)
+	framer := http2.NewFramer(frames, nil)
+
+	if err := framer.WriteRawFrame(http2.FrameSettings, 0, 0, settings); err != nil {
+		return nil, err
+	}
+
+	// Never indexed, so the client's encoder and the server's decoder still agree on the dynamic table.
+	headerBlock := &bytes.Buffer{}
+	encoder := hpack.NewEncoder(headerBlock)
+	encoder.WriteField(hpack.HeaderField{Name: ":method", Value: request.Method, Sensitive: true})
+	encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http", Sensitive: true})
+	encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: request.Host, Sensitive: true})
+	encoder.WriteField(hpack.HeaderField{Name: ":path", Value: request.URL.RequestURI(), Sensitive: true})
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection", "transfer-encoding", "te", "content-length":
+			continue
+		}
+		for _, value := range values {
+			encoder.WriteField(hpack.HeaderField{Name: name, Value: value, Sensitive: true})
+		}
+	}
+	if len(body) > 0 {
+		encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body)), Sensitive: true})
+	}
+
+	// The default SETTINGS_MAX_FRAME_SIZE is larger than any header block the client sends
+	err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: headerBlock.Bytes(),
+		EndStream:     len(body) == 0,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for sent := 0; sent < len(body); {
+		current := min(len(body)-sent, 16384)
+		if err := framer.WriteData(1, sent+current == len(body), body[sent:sent+current]); err != nil {
+			return nil, err
+		}
+		sent += current
+	}
+
+	return frames, nil
+}
+
+// Hand an upgrade request over to the HTTP/2 server, answering it on stream 1.
+func serveH2cUpgrade(h2cServer *http2.Server, handler http.Handler, writer http.ResponseWriter, request *http.Request) {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(request.Header.Get("HTTP2-Settings"), "="))
+	if err != nil || len(settings)%6 != 0 {
+		http.Error(writer, "invalid HTTP2-Settings", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A server may ignore the upgrade, which keeps bodies within the initial flow control window.
+	if len(body) > h2cMaxUpgradeBody {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(writer, request)
+		return
+	}
+
+	frames, err := h2cUpgradeFrames(request, settings, body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := writer.(http.Hijacker).Hijack()
+	if err != nil {
+		fmt.Printf("h2c upgrade failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// The client still sends its preface, which the replayed frames already start with.
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(rw, preface); err != nil || string(preface) != http2.ClientPreface {
+		fmt.Printf("h2c upgrade failed: no client preface\n")
+		return
+	}
+
+	h2cServer.ServeConn(&h2cConn{Conn: conn, reader: io.MultiReader(frames, rw)}, &http2.ServeConnOpts{Handler: handler})
+}
+
+// Wrap handler so it also serves h2c, both with prior knowledge and through Upgrade.
+func h2cHandler(handler http.Handler) http.Handler {
+	h2cServer := &http2.Server{}
+	priorKnowledge := h2c.NewHandler(handler, h2cServer)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.ProtoMajor == 1 && isH2cUpgrade(request) {
+			serveH2cUpgrade(h2cServer, handler, writer, request)
+			return
+		}
+		priorKnowledge.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// quic-go sends every packet of a session to the address the session started
+// from, so on its own it can't follow a client whose address changes (a NAT
+// rebinding, or a client moving to a new socket). The migration server puts a
+// socket underneath it that notices a connection ID arriving from a new
+// address, and redirects what is sent to the old address there. There is no
+// path validation, which a real deployment would need before trusting the new
+// address.
+const migrationConnectionIDLength = 8
+
+// quic-go's idle timeout when the config leaves it unset.
+const defaultQuicIdleTimeout = 30 * time.Second
+
+// Where a connection ID arrived from, or where to send what goes to an address, as of when last used.
+type migrationEntry struct {
+	addr net.Addr
+	used time.Time
+}
+
+type migratingConn struct {
+	net.PacketConn
+
+	// Entries unused for longer than any connection stays idle belong to closed connections.
+	lifetime time.Duration
+
+	mu         sync.Mutex
+	lastAddr   map[string]migrationEntry // last address each connection ID arrived from
+	redirect   map[string]migrationEntry // where to send what is addressed to an old address
+	lastPruned time.Time
+}
+
+func newMigratingConn(conn net.PacketConn, idleTimeout time.Duration) *migratingConn {
+	if idleTimeout == 0 {
+		idleTimeout = defaultQuicIdleTimeout
+	}
+	return &migratingConn{
+		PacketConn: conn,
+		lifetime:   2 * idleTimeout,
+		lastAddr:   make(map[string]migrationEntry),
+		redirect:   make(map[string]migrationEntry),
+		lastPruned: time.Now(),
+	}
+}
+
+// The destination connection ID of a QUIC packet, nil if it's too short to have one.
+func destinationConnectionID(packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	if packet[0]&0x80 == 0 {
+		// Short header: the ID is the one the server chose, so its length is known
+		if len(packet) < 1+migrationConnectionIDLength {
+			return nil
+		}
+		return packet[1 : 1+migrationConnectionIDLength]
+	}
+	// Long header: flags, version, then the length of the ID
+	if len(packet) < 6 || len(packet) < 6+int(packet[5]) {
+		return nil
+	}
+	return packet[6 : 6+int(packet[5])]
+}
+
+func (c *migratingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+
+	if id := destinationConnectionID(p[:n]); id != nil {
+		now := time.Now()
+		c.mu.Lock()
+		previous, ok := c.lastAddr[string(id)]
+		if ok && previous.addr.String() != addr.String() {
+			fmt.Printf("Connection migrated from %s to %s\n", previous.addr, addr)
+			c.redirect[previous.addr.String()] = migrationEntry{addr: addr, used: now}
+			for old, to := range c.redirect {
+				if to.addr.String() == previous.addr.String() {
+					c.redirect[old] = migrationEntry{addr: addr, used: now}
+				}
+			}
+			delete(c.redirect, addr.String())
+		}
+		c.lastAddr[string(id)] = migrationEntry{addr: addr, used: now}
+		if now.Sub(c.lastPruned) > c.lifetime {
+			c.prune(now)
+		}
+		c.mu.Unlock()
+	}
+	return n, addr, err
+}
+
+// Forget the entries of connections that are gone. Called with mu held.
+func (c *migratingConn) prune(now time.Time) {
+	for id, entry := range c.lastAddr {
+		if now.Sub(entry.used) > c.lifetime {
+			delete(c.lastAddr, id)
+		}
+	}
+	for old, entry := range c.redirect {
+		if now.Sub(entry.used) > c.lifetime {
+			delete(c.redirect, old)
+		}
+	}
+	c.lastPruned = now
+}
+
+func (c *migratingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if to, ok := c.redirect[addr.String()]; ok {
+		c.redirect[addr.String()] = migrationEntry{addr: to.addr, used: time.Now()}
+		addr = to.addr
+	}
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Let quic-go grow the receive buffer of the socket, as it does for plain UDP sockets
+func (c *migratingConn) SetReadBuffer(bytes int) error {
+	return udpTuning.setReadBuffer(c.PacketConn.(*net.UDPConn), bytes)
+}
+
+func (c *migratingConn) SyscallConn() (syscall.RawConn, error) {
+	return c.PacketConn.(*net.UDPConn).SyscallConn()
+}
+
+// Start a server answering RPCs on top of QUIC like echoRpcQuicServer, that follows clients to new addresses
+func echoMigrationQuicServer(host string, migrationPort int) error {
+	conn, err := udpTuning.listenUdp(fmt.Sprintf("%s:%d", host, migrationPort))
+	if err != nil {
+		return err
+	}
+	// Clients send a datagram from their new address to announce it (see client/migration.go)
+	quicConf := quicTuning.config(&quic.Config{MaxIncomingStreams: 10000, ConnectionIDLength: migrationConnectionIDLength, EnableDatagrams: true})
+	listener, err := quic.Listen(newMigratingConn(conn, quicConf.MaxIdleTimeout), generateTLSConfig(), quicConf)
+	if err != nil {
+		return err
+	}
+	udpTuning.inspect(conn)
+
+	fmt.Printf("Started migration QUIC server! %s:%d\n", host, migrationPort)
+	return serveRpcQuic(listener)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// The quic-go knobs an experiment can turn, the same as the client's (see
+// client/quicconfig.go). Each is a -quic<Knob> flag taking a single value, so
+// sweeping a server setting means restarting the server. The settings in use
+// are reported by /stats, and recorded by the client with its results.
+var quicKnobs = []struct {
+	name        string
+	description string
+}{
+	{"initialStreamWindow", "Initial stream receive window, in bytes"},
+	{"maxStreamWindow", "Maximum stream receive window, in bytes"},
+	{"initialConnectionWindow", "Initial connection receive window, in bytes"},
+	{"maxConnectionWindow", "Maximum connection receive window, in bytes"},
+	{"idleTimeout", "Idle timeout of sessions, as a duration (30s)"},
+	{"handshakeTimeout", "Idle timeout of handshakes, as a duration (5s)"},
+	{"maxIncomingStreams", "Bidirectional streams the peer may open"},
+	{"maxIncomingUniStreams", "Unidirectional streams the peer may open"},
+	{"keepAlive", "Send keepalives (true or false)"},
+}
+
+// Settings of quic-go, zero where left to quic-go or to what a test asks for.
+type quicSettings struct {
+	initialStreamWindow     uint64
+	maxStreamWindow         uint64
+	initialConnectionWindow uint64
+	maxConnectionWindow     uint64
+	idleTimeout             time.Duration
+	handshakeTimeout        time.Duration
+	maxIncomingStreams      int64
+	maxIncomingUniStreams   int64
+	keepAlive               *bool
+
+	labels []string // name=value of every knob set, in the order of quicKnobs
+}
+
+// The settings every QUIC listener of the server uses.
+var quicTuning = &quicSettings{}
+
+func (s *quicSettings) set(name string, value string) error {
+	var err error
+	switch name {
+	case "initialStreamWindow":
+		s.initialStreamWindow, err = strconv.ParseUint(value, 10, 64)
+	case "maxStreamWindow":
+		s.maxStreamWindow, err = strconv.ParseUint(value, 10, 64)
+	case "initialConnectionWindow":
+		s.initialConnectionWindow, err = strconv.ParseUint(value, 10, 64)
+	case "maxConnectionWindow":
+		s.maxConnectionWindow, err = strconv.ParseUint(value, 10, 64)
+	case "idleTimeout":
+		s.idleTimeout, err = time.ParseDuration(value)
+	case "handshakeTimeout":
+		s.handshakeTimeout, err = time.ParseDuration(value)
+	case "maxIncomingStreams":
+		s.maxIncomingStreams, err = strconv.ParseInt(value, 10, 64)
+	case "maxIncomingUniStreams":
+		s.maxIncomingUniStreams, err = strconv.ParseInt(value, 10, 64)
+	case "keepAlive":
+		var keepAlive bool
+		keepAlive, err = strconv.ParseBool(value)
+		s.keepAlive = &keepAlive
+	default:
+		return fmt.Errorf("unknown QUIC knob %q", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for QUIC knob %s", value, name)
+	}
+	s.labels = append(s.labels, name+"="+value)
+	return nil
+}
+
+// Apply the settings over base, which holds what the caller needs when nothing is set. base may be nil.
+func (s *quicSettings) config(base *quic.Config) *quic.Config {
+	config := &quic.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if s.initialStreamWindow > 0 {
+		config.InitialStreamReceiveWindow = s.initialStreamWindow
+	}
+	if s.maxStreamWindow > 0 {
+		config.MaxStreamReceiveWindow = s.maxStreamWindow
+	}
+	if s.initialConnectionWindow > 0 {
+		config.InitialConnectionReceiveWindow = s.initialConnectionWindow
+	}
+	if s.maxConnectionWindow > 0 {
+		config.MaxConnectionReceiveWindow = s.maxConnectionWindow
+	}
+	if s.idleTimeout > 0 {
+		config.MaxIdleTimeout = s.idleTimeout
+	}
+	if s.handshakeTimeout > 0 {
+		config.HandshakeIdleTimeout = s.handshakeTimeout
+	}
+	if s.maxIncomingStreams != 0 {
+		config.MaxIncomingStreams = s.maxIncomingStreams
+	}
+	if s.maxIncomingUniStreams != 0 {
+		config.MaxIncomingUniStreams = s.maxIncomingUniStreams
+	}
+	if s.keepAlive != nil {
+		config.KeepAlive = *s.keepAlive
+	}
+	return config
+}
+
+// The knobs set, space separated so it fits in a CSV column, or "default".
+func (s *quicSettings) String() string {
+	if len(s.labels) == 0 {
+		return "default"
+	}
+	return strings.Join(s.labels, " ")
+}
+
+// Register a -quic<Knob> flag for every knob.
+func quicFlags() map[string]*string {
+	flags := make(map[string]*string)
+	for _, knob := range quicKnobs {
+		flagName := "quic" + strings.ToUpper(knob.name[:1]) + knob.name[1:]
+		flags[knob.name] = flag.String(flagName, "", knob.description)
+	}
+	return flags
+}
+
+// The settings given by flags, in the order of quicKnobs.
+func parseQuicFlags(flags map[string]*string) (*quicSettings, error) {
+	settings := &quicSettings{}
+	for _, knob := range quicKnobs {
+		if value := *flags[knob.name]; value != "" {
+			if err := settings.set(knob.name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// RPCs over the raw transports start with a header holding the request and
+// response sizes (two big-endian uint32), followed by the request. The server
+// answers with as many bytes as asked for. A TCP connection carries RPCs one
+// after another, a QUIC stream carries a single one.
+const rpcHeaderSize = 8
+const maxRpcRequestSize = 67108864 // 64mb, the largest message the client sends
+
+// Serve one RPC from stream, returning io.EOF if it ended before a new request.
+func handleRpc(stream io.ReadWriter, header []byte) error {
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return err
+	}
+	requestSize := binary.BigEndian.Uint32(header[0:4])
+	responseSize := binary.BigEndian.Uint32(header[4:8])
+	if requestSize > maxRpcRequestSize || responseSize > maxDownloadSize {
+		return fmt.Errorf("RPC of %d/%d bytes is too large", requestSize, responseSize)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, stream, int64(requestSize)); err != nil {
+		return err
+	}
+	for left := int(responseSize); left > 0; {
+		current := min(left, bufferTuning.writeChunk)
+		if _, err := stream.Write(downloadData[:current]); err != nil {
+			return err
+		}
+		left -= current
+	}
+	return nil
+}
+
+func handleRpcTcp(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, rpcHeaderSize)
+	for {
+		if err := handleRpc(conn, header); err != nil {
+			return
+		}
+	}
+}
+
+// Start a server answering RPCs on top of TCP, with TLS if useTls
+func echoRpcTcpServer(host string, rpcPort int, useTls bool) error {
+	var listener net.Listener
+	var err error
+	if useTls {
+		listener, err = tcpTuning.listenTls("tcp", fmt.Sprintf("%s:%d", host, rpcPort), generateTLSConfig())
+	} else {
+		listener, err = tcpTuning.listen("tcp", fmt.Sprintf("%s:%d", host, rpcPort))
+	}
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Started RPC TCP server (TLS: %t)! %s:%d\n", useTls, host, rpcPort)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRpcTcp(conn)
+	}
+}
+
+// Start a server answering RPCs on top of QUIC, one per stream
+func echoRpcQuicServer(host string, rpcPort int) error {
+	quicConf := quicTuning.config(&quic.Config{MaxIncomingStreams: 10000})
+	listener, err := udpTuning.listen(fmt.Sprintf("%s:%d", host, rpcPort), generateTLSConfig(), quicConf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Started RPC QUIC server! %s:%d\n", host, rpcPort)
+	return serveRpcQuic(listener)
+}
+
+// Answer RPCs on every stream of the sessions listener accepts
+func serveRpcQuic(listener quic.Listener) error {
+	for {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			for {
+				stream, err := sess.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					if handleRpc(stream, make([]byte, rpcHeaderSize)) != nil {
+						stream.CancelRead(0)
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// RpcHandler answers POST /rpc?response=<n> with n bytes, after reading the request
+func RpcHandler(writer http.ResponseWriter, request *http.Request) {
+	responseSize, err := strconv.Atoi(request.URL.Query().Get("response"))
+	if err != nil || responseSize < 0 || responseSize > maxDownloadSize {
+		http.Error(writer, "invalid response size", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := io.Copy(ioutil.Discard, request.Body); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writeBytes(writer, responseSize)
+}
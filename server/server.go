@@ -35,16 +35,87 @@ func main() {
 	httpPort := flag.Int("http", 4245, "HTTP port to listen")
 	httpsPort := flag.Int("https", 4246, "HTTPS port to listen")
 	http3Port := flag.Int("http3", 4247, "HTTP3 port to use")
+	webTransportPort := flag.Int("webtransport", 4248, "WebTransport (HTTP/3) port to use")
+	webSocketH2Port := flag.Int("websocketH2", 4249, "WebSocket over HTTP/2 (RFC 8441) port to listen")
+	grpcPort := flag.Int("grpc", 4250, "gRPC (HTTP/2) port to listen")
+	grpcHttp3Port := flag.Int("grpcHttp3", 4251, "gRPC over HTTP3 port to use")
+	rpcTcpPort := flag.Int("rpcTcp", 4252, "RPC over TCP port to listen")
+	rpcTcpTlsPort := flag.Int("rpcTcpTls", 4253, "RPC over TCP TLS port to listen")
+	rpcQuicPort := flag.Int("rpcQuic", 4254, "RPC over QUIC port to listen")
+	migrationPort := flag.Int("migration", 4255, "RPC over QUIC port following clients that change address")
 	//httpQuicPort := flag.Int("httpQuic", 4246, "QUIC HTTP port to listen")
+	quicKnobFlags := quicFlags()
+	tcpNoDelay := flag.Bool("tcpNoDelay", true, "Set TCP_NODELAY on accepted TCP connections")
+	tcpSendBuffer := flag.Int("tcpSendBuffer", 0, "SO_SNDBUF of TCP connections in bytes, the kernel's default if 0")
+	tcpReceiveBuffer := flag.Int("tcpReceiveBuffer", 0, "SO_RCVBUF of TCP connections in bytes, the kernel's default if 0")
+	tcpCongestion := flag.String("tcpCongestion", "", "TCP congestion control algorithm (cubic, bbr, reno...), the kernel's default if empty")
+	tcpFastOpen := flag.Bool("tcpFastOpen", false, "Accept TCP Fast Open on TCP listeners")
+	udpReceiveBuffer := flag.Int("udpReceiveBuffer", 0, "SO_RCVBUF of QUIC sockets in bytes, quic-go's 2 MB if 0")
+	udpSendBuffer := flag.Int("udpSendBuffer", 0, "SO_SNDBUF of QUIC sockets in bytes, the kernel's default if 0")
+	udpEcn := flag.Bool("udpEcn", true, "Let quic-go read ECN bits and packet info of incoming packets")
+	readBuffer := flag.Int("readBuffer", bufferMaxSize, "Bytes asked of every Read of the echo servers")
+	writeChunk := flag.Int("writeChunk", bufferMaxSize, "Largest single Write of responses, in bytes")
+	bufferReuse := flag.String("bufferReuse", bufferReuseConnection, "Read buffer reuse: fresh (one per Read), connection or pool")
 
 	flag.Parse()
 
+	tuning, err := parseQuicFlags(quicKnobFlags)
+	if err != nil {
+		panic(err)
+	}
+	quicTuning = tuning
+	fmt.Printf("QUIC settings: %s\n", quicTuning)
+
+	tcpTuning = &tcpSettings{
+		noDelay:       *tcpNoDelay,
+		sendBuffer:    *tcpSendBuffer,
+		receiveBuffer: *tcpReceiveBuffer,
+		congestion:    *tcpCongestion,
+		fastOpen:      *tcpFastOpen,
+	}
+	if err := tcpTuning.check(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("TCP settings: %s\n", tcpTuning)
+
+	udpTuning = &udpSettings{
+		receiveBuffer: *udpReceiveBuffer,
+		sendBuffer:    *udpSendBuffer,
+		ecn:           *udpEcn,
+	}
+	if err := udpTuning.check(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("UDP settings: %s\n", udpTuning)
+
+	bufferTuning = &bufferSettings{
+		readSize:   *readBuffer,
+		writeChunk: *writeChunk,
+		reuse:      *bufferReuse,
+	}
+	if err := bufferTuning.check(); err != nil {
+		panic(err)
+	}
+	downloadData = make([]byte, bufferTuning.writeChunk)
+	grpcResponseData = make([]byte, bufferTuning.writeChunk)
+	fmt.Printf("Buffer settings: %s\n", bufferTuning)
+
+	raiseFileLimit()
+
 	go echoQuicServer(*host, *quicPort)
 	go echoHttp3Server(*host, *http3Port)
+	go echoWebTransportServer(*host, *webTransportPort)
 	go echoTcpServer(*host, *tcpPort)
 	go echoTcpTlsServer(*host, *tcpTlsPort)
 	go echoHttpServer(*host, *httpPort)
 	go echoHttpsServer(*host, *httpsPort)
+	go echoWebSocketH2Server(*host, *webSocketH2Port)
+	go echoGrpcServer(*host, *grpcPort)
+	go echoGrpcHttp3Server(*host, *grpcHttp3Port)
+	go echoRpcTcpServer(*host, *rpcTcpPort, false)
+	go echoRpcTcpServer(*host, *rpcTcpTlsPort, true)
+	go echoRpcQuicServer(*host, *rpcQuicPort)
+	go echoMigrationQuicServer(*host, *migrationPort)
 
 	select {}
 }
@@ -52,10 +123,12 @@ func main() {
 func handleQuicStream(stream quic.Stream) {
 
 	totalBytes := 0
+	buffers := bufferTuning.buffers()
 
 	for {
-		buf := make([]byte, bufferMaxSize)
+		buf := buffers.get()
 		size, err := stream.Read(buf)
+		buffers.put(buf)
 		if err != nil {
 			//fmt.Printf("QUIC: Got '%d' bytes\n", totalBytes)
 			return
@@ -64,7 +137,7 @@ func handleQuicStream(stream quic.Stream) {
 		responseString := pad([]byte(fmt.Sprintf("%d", size)), 8)
 		_, err = stream.Write(responseString)
 		if err != nil {
-			panic(err)
+			return // the client went away mid-flood, like fan-in clients do at the end
 		}
 
 		totalBytes += size
@@ -87,10 +160,12 @@ func handleTcp(conn net.Conn) {
 	defer conn.Close()
 
 	totalBytes := 0
+	buffers := bufferTuning.buffers()
 
 	for {
-		buf := make([]byte, bufferMaxSize)
+		buf := buffers.get()
 		size, err := conn.Read(buf)
+		buffers.put(buf)
 		if err != nil {
 			// fmt.Printf("TCP: Got '%d' bytes\n", totalBytes)
 			return
@@ -99,7 +174,7 @@ func handleTcp(conn net.Conn) {
 		responseString := pad([]byte(fmt.Sprintf("%d", size)), 8)
 		_, err = conn.Write(responseString)
 		if err != nil {
-			panic(err)
+			return // the client went away mid-flood, like fan-in clients do at the end
 		}
 
 		totalBytes += size
@@ -109,7 +184,7 @@ func handleTcp(conn net.Conn) {
 
 // Start a server that echos all data on top of QUIC
 func echoQuicServer(host string, quicPort int) error {
-	listener, err := quic.ListenAddr(fmt.Sprintf("%s:%d", host, quicPort), generateTLSConfig(), nil)
+	listener, err := udpTuning.listen(fmt.Sprintf("%s:%d", host, quicPort), generateTLSConfig(), quicTuning.config(nil))
 	if err != nil {
 		return err
 	}
@@ -131,7 +206,7 @@ func echoQuicServer(host string, quicPort int) error {
 // Start a server that echos all data on top of TCP
 func echoTcpServer(host string, tcpPort int) error {
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, tcpPort))
+	listener, err := tcpTuning.listen("tcp", fmt.Sprintf("%s:%d", host, tcpPort))
 	if err != nil {
 		return err
 	}
@@ -157,7 +232,7 @@ func echoTcpTlsServer(host string, tcpTlsPort int) error {
 
 	sslCert := generateTLSConfig()
 
-	listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", host, tcpTlsPort), sslCert)
+	listener, err := tcpTuning.listenTls("tcp", fmt.Sprintf("%s:%d", host, tcpTlsPort), sslCert)
 	if err != nil {
 		return err
 	}
@@ -193,30 +268,55 @@ func EchoHandler(writer http.ResponseWriter, request *http.Request) {
 
 func echoHttpServer(host string, httpPort int) {
 
-	fmt.Printf("Started HTTP server! %s:%d\n", host, httpPort)
+	fmt.Printf("Started HTTP server (HTTP/1.1 and h2c)! %s:%d\n", host, httpPort)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", EchoHandler)
-
-	http.ListenAndServe(fmt.Sprintf("%s:%d", host, httpPort), mux)
+	mux.HandleFunc("/bytes/", BytesHandler)
+	mux.HandleFunc("/echo", EchoBodyHandler)
+	mux.HandleFunc("/upload", UploadHandler)
+	mux.HandleFunc("/video/", VideoHandler)
+	mux.HandleFunc("/rpc", RpcHandler)
+	mux.HandleFunc("/stats", StatsHandler)
+	mux.HandleFunc("/ws", WebSocketHandler)
+
+	listener, err := tcpTuning.listen("tcp", fmt.Sprintf("%s:%d", host, httpPort))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	http.Serve(listener, h2cHandler(withServerHeader(mux)))
 
 }
 
 func echoHttpsServer(host string, httpPort int) {
 
 	sslCert := generateTLSConfig()
+	sslCert.NextProtos = []string{"h2", "http/1.1"} // clients pick HTTP/1.1 over TLS through ALPN
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", EchoHandler)
+	mux.HandleFunc("/bytes/", BytesHandler)
+	mux.HandleFunc("/echo", EchoBodyHandler)
+	mux.HandleFunc("/upload", UploadHandler)
+	mux.HandleFunc("/video/", VideoHandler)
+	mux.HandleFunc("/rpc", RpcHandler)
+	mux.HandleFunc("/stats", StatsHandler)
+	mux.HandleFunc("/ws", WebSocketHandler)
 
 	server := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", host, httpPort),
-		Handler:   mux,
+		Handler:   withServerHeader(mux),
 		TLSConfig: sslCert,
 	}
+	listener, err := tcpTuning.listen("tcp", server.Addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("Started HTTPS server! %s:%d\n", host, httpPort)
 
-	server.ListenAndServeTLS("", "")
+	server.ServeTLS(listener, "", "")
 }
 
 func echoHttp3Server(host string, httpPort int) {
@@ -225,18 +325,29 @@ func echoHttp3Server(host string, httpPort int) {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", EchoHandler)
+	mux.HandleFunc("/bytes/", BytesHandler)
+	mux.HandleFunc("/echo", EchoBodyHandler)
+	mux.HandleFunc("/upload", UploadHandler)
+	mux.HandleFunc("/video/", VideoHandler)
+	mux.HandleFunc("/rpc", RpcHandler)
+	mux.HandleFunc("/stats", StatsHandler)
 
 	server := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", host, httpPort),
-		Handler:   mux,
+		Handler:   withServerHeader(mux),
 		TLSConfig: sslCert,
 	}
 
-	quicConf := &quic.Config{MaxIncomingStreams: 128, MaxIncomingUniStreams: 128}
+	quicConf := quicTuning.config(&quic.Config{MaxIncomingStreams: 128, MaxIncomingUniStreams: 128})
 	http3Server := &http3.Server{Server: server, QuicConfig: quicConf}
 	fmt.Printf("Started HTTPS server! %s:%d\n", host, httpPort)
 
-	http3Server.ListenAndServe()
+	conn, err := udpTuning.listenUdp(server.Addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	http3Server.Serve(udpTuning.wrap(conn))
 }
 
 // Setup a bare-bones TLS config for the server
@@ -272,3 +383,14 @@ func pad(bb []byte, size int) []byte {
 	copy(tmp[size-l:], bb)
 	return tmp
 }
+
+/**
+ * Return the minimum value between a and b
+ */
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
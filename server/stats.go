@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// What the server process has used so far, so a client can measure the cost of a workload
+// by reading it before and after.
+type serverStats struct {
+	CpuMicros          int64  `json:"cpuMicros"` // user and system CPU time
+	Goroutines         int    `json:"goroutines"`
+	HeapBytes          uint64 `json:"heapBytes"`          // live heap, after a collection if asked for
+	RssBytes           uint64 `json:"rssBytes"`           // resident memory, 0 where /proc isn't available
+	Quic               string `json:"quic"`               // the QUIC settings in use
+	Tcp                string `json:"tcp"`                // the TCP settings in use
+	Buffers            string `json:"buffers"`            // the buffer settings in use
+	Udp                string `json:"udp"`                // the UDP settings in use
+	UdpEffective       string `json:"udpEffective"`       // what the kernel applied to the last UDP socket
+	QuicImplementation string `json:"quicImplementation"` // module path and version of the QUIC library
+}
+
+// The QUIC library the server was built with, as path@version.
+var quicImplementation = moduleVersion("github.com/lucas-clemente/quic-go")
+
+// Tell HTTP clients what answers them, as interop runs of other clients record it.
+func withServerHeader(handler http.Handler) http.Handler {
+	server := fmt.Sprintf("goquic-server (%s)", quicImplementation)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Server", server)
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				return dep.Path + "@" + dep.Version
+			}
+		}
+	}
+	return path
+}
+
+// Resident memory of the process, from /proc/self/statm
+func residentMemory() uint64 {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// Every connection takes a file descriptor, so allow as many as the hard limit does.
+func raiseFileLimit() {
+	var limit syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit) == nil && limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+}
+
+// StatsHandler answers GET /stats[?gc=1] with the serverStats of the process, collecting garbage first if asked
+func StatsHandler(writer http.ResponseWriter, request *http.Request) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if request.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	stats := serverStats{
+		CpuMicros:          usage.Utime.Nano()/1000 + usage.Stime.Nano()/1000,
+		Goroutines:         runtime.NumGoroutine(),
+		HeapBytes:          memory.HeapAlloc,
+		RssBytes:           residentMemory(),
+		Quic:               quicTuning.String(),
+		Tcp:                tcpTuning.String(),
+		Buffers:            bufferTuning.String(),
+		Udp:                udpTuning.String(),
+		UdpEffective:       udpTuning.applied(),
+		QuicImplementation: quicImplementation,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(stats)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket options of every TCP listener of the server, set by the -tcp* flags
+// like the client's (see client/tcpconfig.go). Accepted connections inherit
+// what is set on the listening socket, except TCP_NODELAY which Go turns on
+// unless told otherwise. The settings in use are reported by /stats.
+type tcpSettings struct {
+	noDelay       bool
+	sendBuffer    int    // SO_SNDBUF, in bytes
+	receiveBuffer int    // SO_RCVBUF, in bytes
+	congestion    string // TCP_CONGESTION, e.g. cubic, bbr or reno
+	fastOpen      bool   // TCP_FASTOPEN, accept data with the SYN
+}
+
+// Connections waiting for their handshake to finish that may already carry data.
+const tcpFastOpenQueue = 256
+
+var tcpTuning = &tcpSettings{noDelay: true}
+
+// The settings that differ from the defaults, space separated, or "default".
+func (s *tcpSettings) String() string {
+	var labels []string
+	if !s.noDelay {
+		labels = append(labels, "noDelay=false")
+	}
+	if s.sendBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("sendBuffer=%d", s.sendBuffer))
+	}
+	if s.receiveBuffer > 0 {
+		labels = append(labels, fmt.Sprintf("receiveBuffer=%d", s.receiveBuffer))
+	}
+	if s.congestion != "" {
+		labels = append(labels, "congestion="+s.congestion)
+	}
+	if s.fastOpen {
+		labels = append(labels, "fastOpen=true")
+	}
+	if len(labels) == 0 {
+		return "default"
+	}
+	return strings.Join(labels, " ")
+}
+
+// Set the options on the listening socket, failing the listen if the kernel refuses one.
+func (s *tcpSettings) control(network string, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if s.sendBuffer > 0 && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, s.sendBuffer)
+		}
+		if s.receiveBuffer > 0 && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, s.receiveBuffer)
+		}
+		if s.congestion != "" && err == nil {
+			err = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, s.congestion)
+		}
+		if s.fastOpen && err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tcpFastOpenQueue)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("TCP settings %s: %s", s, err)
+	}
+	return nil
+}
+
+// tunedListener sets the options Go overrides on every connection it accepts.
+type tunedListener struct {
+	net.Listener
+	settings *tcpSettings
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(l.settings.noDelay)
+	}
+	return conn, nil
+}
+
+// Listen like net.Listen, with the settings.
+func (s *tcpSettings) listen(network string, addr string) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{Control: s.control}
+	listener, err := listenConfig.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tunedListener{Listener: listener, settings: s}, nil
+}
+
+// Fail early if the kernel refuses the settings, rather than in every listener.
+func (s *tcpSettings) check() error {
+	listener, err := s.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// Listen like tls.Listen, with the settings.
+func (s *tcpSettings) listenTls(network string, addr string, config *tls.Config) (net.Listener, error) {
+	listener, err := s.listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, config), nil
+}
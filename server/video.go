@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DASH-style video: the same segments encoded at every bitrate of the ladder,
+// described by /video/manifest.json and fetched from /video/<kbps>/<segment>.
+var videoBitrates = []int{300, 750, 1200, 2400, 4800, 8000} // kbps
+
+const videoSegmentDuration = 2 // seconds
+const videoSegments = 15
+
+type videoManifest struct {
+	SegmentDuration int   `json:"segmentDuration"`
+	Segments        int   `json:"segments"`
+	Bitrates        []int `json:"bitrates"`
+}
+
+// VideoHandler serves the manifest and the segments of the video
+func VideoHandler(writer http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.Path, "/video/")
+	if path == "manifest.json" {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(videoManifest{
+			SegmentDuration: videoSegmentDuration,
+			Segments:        videoSegments,
+			Bitrates:        videoBitrates,
+		})
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(writer, request)
+		return
+	}
+	bitrate, err1 := strconv.Atoi(parts[0])
+	segment, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || segment < 0 || segment >= videoSegments {
+		http.NotFound(writer, request)
+		return
+	}
+	for _, offered := range videoBitrates {
+		if bitrate == offered {
+			writer.Header().Set("Content-Type", "video/iso.segment")
+			writeBytes(writer, bitrate*1000/8*videoSegmentDuration)
+			return
+		}
+	}
+	http.Error(writer, fmt.Sprintf("no %d kbps encoding", bitrate), http.StatusNotFound)
+}
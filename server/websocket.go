@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+)
+
+// WebSocketHandler upgrades an HTTP/1.1 request to a WebSocket and echos the size of every message received
+func WebSocketHandler(writer http.ResponseWriter, request *http.Request) {
+	if !strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		http.Error(writer, "expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(writer, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		// HTTP/2 requests can't be hijacked, those are served by echoWebSocketH2Server instead.
+		http.Error(writer, "websocket upgrades require HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString(fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key)))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	handleWebSocket(rw.Reader, conn)
+}
+
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Echo the size of every data frame, the same way handleTcp acknowledges every read.
+// Client payloads are masked, but since only their size matters they are never unmasked.
+func handleWebSocket(r io.Reader, w io.Writer) {
+
+	totalBytes := 0
+
+	header := make([]byte, 14)
+	for {
+		if _, err := io.ReadFull(r, header[:2]); err != nil {
+			return
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(r, header[2:4]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(header[2:4]))
+		case 127:
+			if _, err := io.ReadFull(r, header[2:10]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(header[2:10])
+		}
+
+		var maskKey [4]byte
+		if masked {
+			if _, err := io.ReadFull(r, maskKey[:]); err != nil {
+				return
+			}
+		}
+
+		switch opcode {
+		case webSocketOpContinuation, webSocketOpText, webSocketOpBinary:
+			size, err := io.CopyN(ioutil.Discard, r, int64(length))
+			if err != nil {
+				return
+			}
+
+			responseString := pad([]byte(fmt.Sprintf("%d", size)), 8)
+			if err := writeWebSocketFrame(w, webSocketOpBinary, responseString); err != nil {
+				return
+			}
+
+			totalBytes += int(size)
+		case webSocketOpPing:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			for i := range payload {
+				payload[i] ^= maskKey[i%4]
+			}
+			if err := writeWebSocketFrame(w, webSocketOpPong, payload); err != nil {
+				return
+			}
+		case webSocketOpPong:
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+				return
+			}
+		case webSocketOpClose:
+			io.CopyN(ioutil.Discard, r, int64(length))
+			writeWebSocketFrame(w, webSocketOpClose, nil)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// Write a single unmasked (server to client) frame.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// RFC 8441 bootstraps WebSockets with an extended CONNECT on an HTTP/2 stream.
+// Neither net/http nor the x/net version usable with quic-go v0.25 accept the
+// :protocol pseudo-header, so this endpoint runs a minimal HTTP/2 connection of
+// its own which only serves extended CONNECT requests for websockets.
+const (
+	h2SettingEnableConnectProtocol = http2.SettingID(0x8)
+	h2DefaultWindowSize            = 65535
+	h2WindowSize                   = 4194304 // 4mb, same as the stream window of net/http's transport
+)
+
+type h2Conn struct {
+	framer  *http2.Framer
+	decoder *hpack.Decoder
+
+	writeMu   sync.Mutex // guards framer writes and the encoder
+	headerBuf bytes.Buffer
+	encoder   *hpack.Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*h2Stream
+	sendWindow        int32
+	peerInitialWindow int32
+	peerMaxFrameSize  uint32
+	closeErr          error
+
+	onHeaders func(streamID uint32, fields []hpack.HeaderField)
+}
+
+type h2Stream struct {
+	conn       *h2Conn
+	id         uint32
+	recv       bytes.Buffer
+	recvErr    error
+	sendErr    error
+	sendWindow int32
+	unacked    int // bytes consumed since the last WINDOW_UPDATE
+}
+
+func newH2Conn(conn net.Conn, onHeaders func(streamID uint32, fields []hpack.HeaderField)) *h2Conn {
+	c := &h2Conn{
+		framer:            http2.NewFramer(conn, conn),
+		decoder:           hpack.NewDecoder(4096, nil),
+		streams:           make(map[uint32]*h2Stream),
+		sendWindow:        h2DefaultWindowSize,
+		peerInitialWindow: h2DefaultWindowSize,
+		peerMaxFrameSize:  16384,
+		onHeaders:         onHeaders,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.encoder = hpack.NewEncoder(&c.headerBuf)
+	return c
+}
+
+func (c *h2Conn) writeSettings(settings ...http2.Setting) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	settings = append(settings, http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2WindowSize})
+	if err := c.framer.WriteSettings(settings...); err != nil {
+		return err
+	}
+	return c.framer.WriteWindowUpdate(0, h2WindowSize-h2DefaultWindowSize)
+}
+
+func (c *h2Conn) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.headerBuf.Reset()
+	for _, field := range fields {
+		if err := c.encoder.WriteField(field); err != nil {
+			return err
+		}
+	}
+	return c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: c.headerBuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+func (c *h2Conn) newStream(streamID uint32) *h2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stream := &h2Stream{conn: c, id: streamID, sendWindow: c.peerInitialWindow}
+	c.streams[streamID] = stream
+	return stream
+}
+
+// Give back flow control credit for data consumed (or dropped) on a stream.
+func (c *h2Conn) writeWindowUpdate(streamID uint32, increment int) {
+	if increment <= 0 {
+		return
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.framer.WriteWindowUpdate(0, uint32(increment))
+	if streamID != 0 {
+		c.framer.WriteWindowUpdate(streamID, uint32(increment))
+	}
+}
+
+func (c *h2Conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeErr = err
+	for _, stream := range c.streams {
+		if stream.recvErr == nil {
+			stream.recvErr = err
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// Read frames until the connection fails, dispatching data to the streams.
+func (c *h2Conn) readLoop() {
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			c.mu.Lock()
+			f.ForeachSetting(func(setting http2.Setting) error {
+				switch setting.ID {
+				case http2.SettingInitialWindowSize:
+					delta := int32(setting.Val) - c.peerInitialWindow
+					for _, stream := range c.streams {
+						stream.sendWindow += delta
+					}
+					c.peerInitialWindow = int32(setting.Val)
+				case http2.SettingMaxFrameSize:
+					c.peerMaxFrameSize = setting.Val
+				}
+				return nil
+			})
+			c.cond.Broadcast()
+			c.mu.Unlock()
+
+			c.writeMu.Lock()
+			c.framer.WriteSettingsAck()
+			c.writeMu.Unlock()
+		case *http2.WindowUpdateFrame:
+			c.mu.Lock()
+			if f.StreamID == 0 {
+				c.sendWindow += int32(f.Increment)
+			} else if stream, ok := c.streams[f.StreamID]; ok {
+				stream.sendWindow += int32(f.Increment)
+			}
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				c.writeMu.Lock()
+				c.framer.WritePing(true, f.Data)
+				c.writeMu.Unlock()
+			}
+		case *http2.HeadersFrame:
+			block := append([]byte{}, f.HeaderBlockFragment()...)
+			for ended := f.HeadersEnded(); !ended; {
+				next, err := c.framer.ReadFrame()
+				if err != nil {
+					c.close(err)
+					return
+				}
+				continuation, ok := next.(*http2.ContinuationFrame)
+				if !ok {
+					c.close(errors.New("expected CONTINUATION frame"))
+					return
+				}
+				block = append(block, continuation.HeaderBlockFragment()...)
+				ended = continuation.HeadersEnded()
+			}
+
+			fields, err := c.decoder.DecodeFull(block)
+			if err != nil {
+				c.close(err)
+				return
+			}
+			c.onHeaders(f.StreamID, fields)
+		case *http2.DataFrame:
+			data := f.Data()
+			padding := int(f.Header().Length) - len(data)
+
+			c.mu.Lock()
+			stream, ok := c.streams[f.StreamID]
+			if ok {
+				stream.recv.Write(data)
+				if f.StreamEnded() {
+					stream.recvErr = io.EOF
+				}
+				c.cond.Broadcast()
+			}
+			c.mu.Unlock()
+
+			if !ok {
+				padding += len(data)
+			}
+			c.writeWindowUpdate(f.StreamID, padding)
+		case *http2.RSTStreamFrame:
+			c.mu.Lock()
+			if stream, ok := c.streams[f.StreamID]; ok {
+				stream.recvErr = http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode}
+				stream.sendErr = stream.recvErr
+				c.cond.Broadcast()
+			}
+			c.mu.Unlock()
+		case *http2.GoAwayFrame:
+			c.close(fmt.Errorf("received GOAWAY: %s", f.ErrCode))
+			return
+		}
+	}
+}
+
+func (s *h2Stream) Read(buf []byte) (int, error) {
+	c := s.conn
+
+	c.mu.Lock()
+	for s.recv.Len() == 0 && s.recvErr == nil {
+		c.cond.Wait()
+	}
+	if s.recv.Len() == 0 {
+		err := s.recvErr
+		c.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.recv.Read(buf)
+	s.unacked += n
+	increment := 0
+	if s.unacked >= h2WindowSize/4 {
+		increment = s.unacked
+		s.unacked = 0
+	}
+	c.mu.Unlock()
+
+	c.writeWindowUpdate(s.id, increment)
+	return n, nil
+}
+
+func (s *h2Stream) Write(data []byte) (int, error) {
+	c := s.conn
+	written := 0
+
+	for written < len(data) {
+		c.mu.Lock()
+		for (s.sendWindow <= 0 || c.sendWindow <= 0) && c.closeErr == nil && s.sendErr == nil {
+			c.cond.Wait()
+		}
+		if c.closeErr != nil || s.sendErr != nil {
+			err := c.closeErr
+			if err == nil {
+				err = s.sendErr
+			}
+			c.mu.Unlock()
+			return written, err
+		}
+
+		current := min(len(data)-written, int(s.sendWindow))
+		current = min(current, int(c.sendWindow))
+		current = min(current, int(c.peerMaxFrameSize))
+		s.sendWindow -= int32(current)
+		c.sendWindow -= int32(current)
+		c.mu.Unlock()
+
+		c.writeMu.Lock()
+		err := c.framer.WriteData(s.id, false, data[written:written+current])
+		c.writeMu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += current
+	}
+
+	return written, nil
+}
+
+// Close ends our side of the stream.
+func (s *h2Stream) Close() error {
+	c := s.conn
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.framer.WriteData(s.id, true, nil)
+}
+
+// Start a server that echos all data on top of WebSockets bootstrapped over HTTP/2 (RFC 8441)
+func echoWebSocketH2Server(host string, webSocketH2Port int) error {
+
+	tlsConf := generateTLSConfig()
+	tlsConf.NextProtos = []string{http2.NextProtoTLS}
+
+	listener, err := tcpTuning.listenTls("tcp", fmt.Sprintf("%s:%d", host, webSocketH2Port), tlsConf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Started WebSocket HTTP/2 server! %s:%d\n", host, webSocketH2Port)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleWebSocketH2(conn)
+	}
+}
+
+func handleWebSocketH2(conn net.Conn) {
+	defer conn.Close()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+
+	var c *h2Conn
+	c = newH2Conn(conn, func(streamID uint32, fields []hpack.HeaderField) {
+		var method, protocol string
+		for _, field := range fields {
+			switch field.Name {
+			case ":method":
+				method = field.Value
+			case ":protocol":
+				protocol = field.Value
+			}
+		}
+
+		if method != "CONNECT" || protocol != "websocket" {
+			c.writeHeaders(streamID, []hpack.HeaderField{{Name: ":status", Value: "400"}}, true)
+			return
+		}
+
+		stream := c.newStream(streamID)
+		c.writeHeaders(streamID, []hpack.HeaderField{{Name: ":status", Value: "200"}}, false)
+		go func() {
+			handleWebSocket(stream, stream)
+			stream.Close()
+		}()
+	})
+
+	if err := c.writeSettings(http2.Setting{ID: h2SettingEnableConnectProtocol, Val: 1}); err != nil {
+		return
+	}
+	c.readLoop()
+}
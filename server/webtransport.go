@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/marten-seemann/qpack"
+)
+
+// quic-go v0.25's http3 package doesn't support extended CONNECT, so the
+// WebTransport endpoint speaks the draft-ietf-webtrans-http3 framing itself:
+// a control stream with SETTINGS, a CONNECT request on the first bidirectional
+// stream, and session-prefixed streams and datagrams after that.
+const (
+	h3StreamTypeControl        = 0x00
+	h3FrameTypeHeaders         = 0x01
+	h3FrameTypeSettings        = 0x04
+	h3SettingEnableConnect     = 0x08
+	h3SettingDatagram          = 0xffd277
+	h3SettingEnableWebTrans    = 0x2b603742
+	webTransportUniStreamType  = 0x54
+	webTransportBidiSignal     = 0x41
+	webTransportMaxHeaderBytes = 16384
+)
+
+// Start a server that echos all data on top of WebTransport (over HTTP/3)
+func echoWebTransportServer(host string, webTransportPort int) error {
+	tlsConf := generateTLSConfig()
+	quicConf := quicTuning.config(&quic.Config{MaxIncomingStreams: 128, MaxIncomingUniStreams: 128, EnableDatagrams: true})
+
+	listener, err := udpTuning.listen(fmt.Sprintf("%s:%d", host, webTransportPort), tlsConf, quicConf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Started WebTransport server! %s:%d\n", host, webTransportPort)
+
+	for {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		go handleWebTransportSession(sess)
+	}
+}
+
+func handleWebTransportSession(sess quic.Session) {
+	control, err := sess.OpenUniStream()
+	if err != nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3StreamTypeControl)
+	writeWebTransportSettings(buf)
+	if _, err := control.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	go handleWebTransportUniStreams(sess)
+
+	// The first bidirectional stream carries the extended CONNECT request, and its ID is the session ID.
+	connectStream, err := sess.AcceptStream(context.Background())
+	if err != nil {
+		return
+	}
+	if err := acceptWebTransportConnect(connectStream); err != nil {
+		fmt.Printf("WebTransport: rejected session from %s: %s\n", sess.RemoteAddr(), err)
+		sess.CloseWithError(0x10c, err.Error()) // H3_REQUEST_REJECTED
+		return
+	}
+	sessionID := uint64(connectStream.StreamID())
+
+	go handleWebTransportDatagrams(sess, sessionID)
+
+	for {
+		stream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go handleWebTransportStream(stream, sessionID)
+	}
+}
+
+func writeWebTransportSettings(buf *bytes.Buffer) {
+	settings := &bytes.Buffer{}
+	quicvarint.Write(settings, h3SettingEnableConnect)
+	quicvarint.Write(settings, 1)
+	quicvarint.Write(settings, h3SettingDatagram)
+	quicvarint.Write(settings, 1)
+	quicvarint.Write(settings, h3SettingEnableWebTrans)
+	quicvarint.Write(settings, 1)
+
+	quicvarint.Write(buf, h3FrameTypeSettings)
+	quicvarint.Write(buf, uint64(settings.Len()))
+	buf.Write(settings.Bytes())
+}
+
+func readWebTransportHeaders(r io.Reader) ([]qpack.HeaderField, error) {
+	qr := quicvarint.NewReader(r)
+	frameType, err := quicvarint.Read(qr)
+	if err != nil {
+		return nil, err
+	}
+	length, err := quicvarint.Read(qr)
+	if err != nil {
+		return nil, err
+	}
+	if frameType != h3FrameTypeHeaders {
+		return nil, fmt.Errorf("expected HEADERS frame, got 0x%x", frameType)
+	}
+	if length > webTransportMaxHeaderBytes {
+		return nil, fmt.Errorf("HEADERS frame too large: %d bytes", length)
+	}
+
+	headerBlock := make([]byte, length)
+	if _, err := io.ReadFull(r, headerBlock); err != nil {
+		return nil, err
+	}
+	return qpack.NewDecoder(nil).DecodeFull(headerBlock)
+}
+
+func writeWebTransportHeaders(w io.Writer, fields []qpack.HeaderField) error {
+	headerBlock := &bytes.Buffer{}
+	encoder := qpack.NewEncoder(headerBlock)
+	for _, field := range fields {
+		if err := encoder.WriteField(field); err != nil {
+			return err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, h3FrameTypeHeaders)
+	quicvarint.Write(buf, uint64(headerBlock.Len()))
+	buf.Write(headerBlock.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func acceptWebTransportConnect(stream quic.Stream) error {
+	fields, err := readWebTransportHeaders(stream)
+	if err != nil {
+		return err
+	}
+
+	var method, protocol string
+	for _, field := range fields {
+		switch field.Name {
+		case ":method":
+			method = field.Value
+		case ":protocol":
+			protocol = field.Value
+		}
+	}
+
+	if method != http.MethodConnect || protocol != "webtransport" {
+		writeWebTransportHeaders(stream, []qpack.HeaderField{{Name: ":status", Value: "400"}})
+		return errors.New("expected an extended CONNECT request for webtransport")
+	}
+
+	return writeWebTransportHeaders(stream, []qpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "sec-webtransport-http3-draft", Value: "draft02"},
+	})
+}
+
+// Bidirectional WebTransport streams behave exactly like raw QUIC streams once the session prefix is read.
+func handleWebTransportStream(stream quic.Stream, sessionID uint64) {
+	qr := quicvarint.NewReader(stream)
+	signal, err := quicvarint.Read(qr)
+	if err != nil || signal != webTransportBidiSignal {
+		stream.CancelRead(0x10c)
+		return
+	}
+	id, err := quicvarint.Read(qr)
+	if err != nil || id != sessionID {
+		stream.CancelRead(0x10c)
+		return
+	}
+
+	handleQuicStream(stream)
+}
+
+// Unidirectional streams can't be answered in place, so the byte count is
+// acknowledged on a new server-initiated unidirectional stream once the client closes its stream.
+func handleWebTransportUniStreams(sess quic.Session) {
+	for {
+		stream, err := sess.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go func(stream quic.ReceiveStream) {
+			qr := quicvarint.NewReader(stream)
+			streamType, err := quicvarint.Read(qr)
+			if err != nil {
+				return
+			}
+
+			switch streamType {
+			case webTransportUniStreamType:
+			case h3StreamTypeControl:
+				// Nothing in the client's SETTINGS changes how we echo.
+				io.Copy(ioutil.Discard, stream)
+				return
+			default:
+				// QPACK encoder/decoder streams are unused, since the dynamic table is never used.
+				stream.CancelRead(0x103) // H3_STREAM_CREATION_ERROR
+				return
+			}
+
+			sessionID, err := quicvarint.Read(qr)
+			if err != nil {
+				return
+			}
+
+			totalBytes, _ := io.Copy(ioutil.Discard, stream)
+
+			ack, err := sess.OpenUniStream()
+			if err != nil {
+				return
+			}
+			defer ack.Close()
+
+			buf := &bytes.Buffer{}
+			quicvarint.Write(buf, webTransportUniStreamType)
+			quicvarint.Write(buf, sessionID)
+			buf.Write(pad([]byte(fmt.Sprintf("%d", totalBytes)), 8))
+			ack.Write(buf.Bytes())
+		}(stream)
+	}
+}
+
+// Every datagram is acknowledged by a datagram carrying its transfer ID and payload size, so the client can
+// measure the delivery of each transfer apart from late acknowledgements of the ones before.
+func handleWebTransportDatagrams(sess quic.Session, sessionID uint64) {
+	prefix := &bytes.Buffer{}
+	quicvarint.Write(prefix, sessionID/4)
+
+	for {
+		message, err := sess.ReceiveMessage()
+		if err != nil {
+			return
+		}
+
+		reader := bytes.NewReader(message)
+		quarterStreamID, err := quicvarint.Read(reader)
+		if err != nil || quarterStreamID != sessionID/4 {
+			continue
+		}
+		transfer, err := quicvarint.Read(reader)
+		if err != nil {
+			continue
+		}
+
+		response := bytes.NewBuffer(append([]byte{}, prefix.Bytes()...))
+		quicvarint.Write(response, transfer)
+		response.Write(pad([]byte(fmt.Sprintf("%d", reader.Len())), 8))
+		if err := sess.SendMessage(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Beside the upload of EchoHandler, the HTTP servers offer the other directions
+// of bulk transfer: downloads from /bytes/<n>, and a full echo at /echo. Those
+// and /upload follow plain GET and POST semantics, so any HTTP client can use
+// them (see the interop mode of the client).
+const maxDownloadSize = 1073741824 // 1gb
+
+// Nothing compresses the responses, so zeros are as good as random data.
+// main sizes it to the write chunk.
+var downloadData = make([]byte, bufferMaxSize)
+
+// BytesHandler answers GET /bytes/<n> with n bytes, of the content type in ?type= if given
+func BytesHandler(writer http.ResponseWriter, request *http.Request) {
+	size, err := strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/bytes/"))
+	if err != nil || size < 0 || size > maxDownloadSize {
+		http.Error(writer, fmt.Sprintf("invalid size in %s", request.URL.Path), http.StatusBadRequest)
+		return
+	}
+
+	contentType := request.URL.Query().Get("type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writeBytes(writer, size)
+}
+
+// Send a response body of size bytes.
+func writeBytes(writer http.ResponseWriter, size int) {
+	writer.Header().Set("Content-Length", strconv.Itoa(size))
+	for left := size; left > 0; {
+		current := min(left, bufferTuning.writeChunk)
+		if _, err := writer.Write(downloadData[:current]); err != nil {
+			return
+		}
+		left -= current
+	}
+}
+
+// EchoBodyHandler sends the whole request body back. HTTP/2 and HTTP/3 stream it back
+// while it arrives, but net/http's HTTP/1 server can't read the body once the response
+// has started, so there it is read in full first.
+func EchoBodyHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/octet-stream")
+
+	if request.ProtoMajor == 1 {
+		data, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		writer.Write(data)
+		return
+	}
+
+	flusher, _ := writer.(http.Flusher)
+	buffers := bufferTuning.buffers()
+	buf := buffers.get()
+	defer buffers.put(buf)
+	for {
+		n, err := request.Body.Read(buf)
+		if n > 0 {
+			if _, errWrite := writer.Write(buf[:n]); errWrite != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// UploadHandler takes a POST body of any size and answers with its length in bytes, as text
+func UploadHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost && request.Method != http.MethodPut {
+		writer.Header().Set("Allow", "POST, PUT")
+		http.Error(writer, "upload with POST or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	buffers := bufferTuning.buffers()
+	buf := buffers.get()
+	defer buffers.put(buf)
+	received := 0
+	for {
+		n, err := request.Body.Read(buf)
+		received += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writer.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(writer, "%d\n", received)
+}